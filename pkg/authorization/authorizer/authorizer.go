@@ -3,6 +3,10 @@ package authorizer
 import (
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
 
 	kapi "k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/auth/user"
@@ -17,13 +21,27 @@ import (
 	usercache "github.com/openshift/origin/pkg/user/cache"
 )
 
+// FullScope is a cluster-level escape hatch scope.  A token carrying it is treated as
+// unscoped: scope intersection is skipped entirely and the full set of rules the user
+// is otherwise bound to applies.
+const FullScope = "user:full"
+
+// ScopeEvaluator resolves a single authorization scope (e.g. "user:info" or
+// "role:view:my-namespace") to the set of PolicyRules it grants.  It exists so that
+// the set of scopes this authorizer understands can be extended without changing
+// openshiftAuthorizer itself.
+type ScopeEvaluator interface {
+	Resolve(scope, namespace string) ([]authorizationapi.PolicyRule, error)
+}
+
 type openshiftAuthorizer struct {
 	ruleResolver          rulevalidation.AuthorizationRuleResolver
 	forbiddenMessageMaker ForbiddenMessageMaker
+	scopeEvaluator        ScopeEvaluator
 }
 
-func NewAuthorizer(ruleResolver rulevalidation.AuthorizationRuleResolver, forbiddenMessageMaker ForbiddenMessageMaker) Authorizer {
-	return &openshiftAuthorizer{ruleResolver, forbiddenMessageMaker}
+func NewAuthorizer(ruleResolver rulevalidation.AuthorizationRuleResolver, forbiddenMessageMaker ForbiddenMessageMaker, scopeEvaluator ScopeEvaluator) Authorizer {
+	return &openshiftAuthorizer{ruleResolver, forbiddenMessageMaker, scopeEvaluator}
 }
 
 func (a *openshiftAuthorizer) Authorize(ctx kapi.Context, passedAttributes Action) (bool, string, error) {
@@ -43,6 +61,12 @@ func (a *openshiftAuthorizer) Authorize(ctx kapi.Context, passedAttributes Actio
 		return false, "", err
 	}
 
+	// a scope-specific denial already carries a precise reason; prefer it over the
+	// generic forbidden message.
+	if len(reason) > 0 {
+		return false, reason, nil
+	}
+
 	denyReason, err := a.forbiddenMessageMaker.MakeMessage(MessageContext{user, namespace, attributes})
 	if err != nil {
 		denyReason = err.Error()
@@ -51,23 +75,215 @@ func (a *openshiftAuthorizer) Authorize(ctx kapi.Context, passedAttributes Actio
 	return false, denyReason, nil
 }
 
+// AuthorizationDecision is the structured result of an authorization check.  Unlike
+// the free-form reason string Authorize returns, it carries enough about the winning
+// role binding that a caller (e.g. an audit log or a "why was I denied" debugging
+// endpoint) can point at the exact role, binding, and rule responsible without
+// re-parsing the reason text.
+type AuthorizationDecision struct {
+	Allowed               bool
+	Reason                string
+	Role                  string
+	RoleBinding           string
+	MatchingRule          *authorizationapi.PolicyRule
+	MatchingRoleNamespace string
+	EvaluationErrors      []error
+}
+
+// AuthorizeWithDecision behaves like Authorize, but on an allow it additionally
+// reports which role, role binding, and rule supplied the match. The allow/deny
+// result always comes from authorizeWithNamespaceRules - the same path Authorize
+// uses - so the two entry points can never disagree about the outcome;
+// findMatchingRoleBinding only labels an already-decided allow with its provenance.
+func (a *openshiftAuthorizer) AuthorizeWithDecision(ctx kapi.Context, passedAttributes Action) (AuthorizationDecision, error) {
+	attributes := CoerceToDefaultAuthorizationAttributes(passedAttributes)
+
+	user, ok := kapi.UserFrom(ctx)
+	if !ok {
+		return AuthorizationDecision{}, errors.New("no user available on context")
+	}
+	namespace, _ := kapi.NamespaceFrom(ctx)
+
+	allowed, reason, err := a.authorizeWithNamespaceRules(user, namespace, attributes)
+	decision := AuthorizationDecision{Allowed: allowed, Reason: reason}
+	if err != nil {
+		decision.EvaluationErrors = append(decision.EvaluationErrors, err)
+	}
+	if allowed {
+		if match, found := a.findMatchingRoleBinding(user, namespace, attributes); found {
+			decision.Role = match.Role
+			decision.RoleBinding = match.RoleBinding
+			decision.MatchingRule = match.MatchingRule
+			decision.MatchingRoleNamespace = match.MatchingRoleNamespace
+		}
+		return decision, nil
+	}
+	if len(reason) > 0 {
+		return decision, nil
+	}
+
+	denyReason, msgErr := a.forbiddenMessageMaker.MakeMessage(MessageContext{user, namespace, attributes})
+	if msgErr != nil {
+		denyReason = msgErr.Error()
+	}
+	decision.Reason = denyReason
+	return decision, nil
+}
+
+// roleBindingMatch is the provenance findMatchingRoleBinding reports for an allow
+// authorizeWithNamespaceRules has already established.
+type roleBindingMatch struct {
+	Role                  string
+	RoleBinding           string
+	MatchingRule          *authorizationapi.PolicyRule
+	MatchingRoleNamespace string
+}
+
+// findMatchingRoleBinding walks the role bindings that apply to user in namespace to
+// identify which role, binding, and rule produced an allow. It never decides
+// allow/deny itself - that already happened in authorizeWithNamespaceRules - so a
+// lookup miss here (e.g. from an evaluation error) just means the decision comes
+// back without provenance, not a different answer.
+func (a *openshiftAuthorizer) findMatchingRoleBinding(user user.Info, namespace string, attributes *DefaultAuthorizationAttributes) (roleBindingMatch, bool) {
+	roleBindings, err := a.ruleResolver.GetRoleBindings(namespace)
+	if err != nil {
+		return roleBindingMatch{}, false
+	}
+
+	scopes := user.GetExtra()[authorizationapi.ScopesKey]
+	for _, roleBinding := range roleBindings {
+		if !doesApplyToUser(roleBinding.Users(), roleBinding.Groups(), user) {
+			continue
+		}
+		role, err := a.ruleResolver.GetRole(roleBinding)
+		if err != nil {
+			continue
+		}
+
+		rulesToCheck := role.Rules()
+		if len(scopes) > 0 {
+			scopedRules, err := a.scopeLimitedRules(scopes, namespace, rulesToCheck)
+			if err != nil {
+				continue
+			}
+			rulesToCheck = scopedRules
+		}
+
+		for i, rule := range rulesToCheck {
+			matches, err := attributes.RuleMatches(rule)
+			if err != nil || !matches {
+				continue
+			}
+			return roleBindingMatch{
+				Role:                  role.Name(),
+				RoleBinding:           roleBinding.Name(),
+				MatchingRule:          &rulesToCheck[i],
+				MatchingRoleNamespace: namespace,
+			}, true
+		}
+	}
+	return roleBindingMatch{}, false
+}
+
+// SubjectProvenance pairs a set of allowed subjects with the role and role binding
+// that grants them the match, for callers of GetAllowedSubjectsWithProvenance that
+// need to explain *why* a subject showed up in the answer.
+type SubjectProvenance struct {
+	Role        string
+	RoleBinding string
+	Users       sets.String
+	Groups      sets.String
+}
+
+// GetAllowedSubjectsWithProvenance behaves like GetAllowedSubjects, but reports one
+// SubjectProvenance per role binding that contributed a match instead of merging
+// every match into a single pair of sets.
+func (a *openshiftAuthorizer) GetAllowedSubjectsWithProvenance(ctx kapi.Context, passedAttributes Action) ([]SubjectProvenance, error) {
+	namespace, _ := kapi.NamespaceFrom(ctx)
+	attributes := CoerceToDefaultAuthorizationAttributes(passedAttributes)
+
+	var scopes []string
+	if callingUser, ok := kapi.UserFrom(ctx); ok {
+		scopes = callingUser.GetExtra()[authorizationapi.ScopesKey]
+	}
+
+	roleBindings, err := a.ruleResolver.GetRoleBindings(namespace)
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	results := []SubjectProvenance{}
+	for _, roleBinding := range roleBindings {
+		role, err := a.ruleResolver.GetRole(roleBinding)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		rulesToCheck := role.Rules()
+		if len(scopes) > 0 {
+			scopedRules, err := a.scopeLimitedRules(scopes, namespace, rulesToCheck)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			rulesToCheck = scopedRules
+		}
+
+		for _, rule := range rulesToCheck {
+			matches, err := attributes.RuleMatches(rule)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if matches {
+				results = append(results, SubjectProvenance{
+					Role:        role.Name(),
+					RoleBinding: roleBinding.Name(),
+					Users:       sets.NewString(roleBinding.Users().List()...),
+					Groups:      sets.NewString(roleBinding.Groups().List()...),
+				})
+				break
+			}
+		}
+	}
+
+	return results, kerrors.NewAggregate(errs)
+}
+
 // GetAllowedSubjects returns the subjects it knows can perform the action.
 // If we got an error, then the list of subjects may not be complete, but it does not contain any incorrect names.
 // This is done because policy rules are purely additive and policy determinations
 // can be made on the basis of those rules that are found.
 func (a *openshiftAuthorizer) GetAllowedSubjects(ctx kapi.Context, attributes Action) (sets.String, sets.String, error) {
 	namespace, _ := kapi.NamespaceFrom(ctx)
-	return a.getAllowedSubjectsFromNamespaceBindings(namespace, attributes)
+
+	// a scoped caller asking "who can do X" must not learn about bindings its own
+	// token couldn't act through - apply the same scope narrowing the forward
+	// Authorize check applies, keyed off the caller rather than the subject being
+	// matched against each binding.
+	var scopes []string
+	if callingUser, ok := kapi.UserFrom(ctx); ok {
+		scopes = callingUser.GetExtra()[authorizationapi.ScopesKey]
+	}
+	return a.getAllowedSubjectsFromNamespaceBindings(namespace, scopes, attributes)
 }
 
-func (a *openshiftAuthorizer) getAllowedSubjectsFromNamespaceBindings(namespace string, passedAttributes Action) (sets.String, sets.String, error) {
+func (a *openshiftAuthorizer) getAllowedSubjectsFromNamespaceBindings(namespace string, scopes []string, passedAttributes Action) (sets.String, sets.String, error) {
+	roleBindings, err := a.ruleResolver.GetRoleBindings(namespace)
+	return a.subjectsForRoleBindings(roleBindings, err, namespace, scopes, passedAttributes)
+}
+
+// subjectsForRoleBindings is the part of getAllowedSubjectsFromNamespaceBindings that
+// doesn't need to re-fetch role bindings, so GetAllowedSubjectsBatch can fetch them
+// once and reuse this across every action in the batch.
+func (a *openshiftAuthorizer) subjectsForRoleBindings(roleBindings []rulevalidation.RoleBinding, bindingRetrievalErr error, namespace string, scopes []string, passedAttributes Action) (sets.String, sets.String, error) {
 	attributes := CoerceToDefaultAuthorizationAttributes(passedAttributes)
 
 	var errs []error
-
-	roleBindings, err := a.ruleResolver.GetRoleBindings(namespace)
-	if err != nil {
-		errs = append(errs, err)
+	if bindingRetrievalErr != nil {
+		errs = append(errs, bindingRetrievalErr)
 	}
 
 	users := sets.String{}
@@ -82,7 +298,17 @@ func (a *openshiftAuthorizer) getAllowedSubjectsFromNamespaceBindings(namespace
 			continue
 		}
 
-		for _, rule := range role.Rules() {
+		rulesToCheck := role.Rules()
+		if len(scopes) > 0 {
+			scopedRules, err := a.scopeLimitedRules(scopes, namespace, rulesToCheck)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			rulesToCheck = scopedRules
+		}
+
+		for _, rule := range rulesToCheck {
 			matches, err := attributes.RuleMatches(rule)
 			if err != nil {
 				errs = append(errs, err)
@@ -107,8 +333,25 @@ func (a *openshiftAuthorizer) authorizeWithNamespaceRules(user user.Info, namesp
 
 	allRules, ruleRetrievalError := a.ruleResolver.RulesFor(user, namespace)
 
+	rulesToCheck := allRules
+	scopes := user.GetExtra()[authorizationapi.ScopesKey]
+	if len(scopes) > 0 {
+		scopedRules, err := a.scopeLimitedRules(scopes, namespace, allRules)
+		if err != nil {
+			return false, "", err
+		}
+		rulesToCheck = scopedRules
+	}
+
+	return evaluateRules(rulesToCheck, allRules, scopes, namespace, attributes, ruleRetrievalError)
+}
+
+// evaluateRules is the rule-matching tail of authorizeWithNamespaceRules, split out
+// so AuthorizeBatch can resolve a user's rules once and evaluate many actions against
+// them instead of paying RulesFor's cost again for every action in the batch.
+func evaluateRules(rulesToCheck []authorizationapi.PolicyRule, allRules []authorizationapi.PolicyRule, scopes []string, namespace string, attributes *DefaultAuthorizationAttributes, ruleRetrievalError error) (bool, string, error) {
 	var errs []error
-	for _, rule := range allRules {
+	for _, rule := range rulesToCheck {
 		matches, err := attributes.RuleMatches(rule)
 		if err != nil {
 			errs = append(errs, err)
@@ -123,6 +366,18 @@ func (a *openshiftAuthorizer) authorizeWithNamespaceRules(user user.Info, namesp
 			return true, "allowed by rule in " + namespace, nil
 		}
 	}
+
+	// the user holds rules that would otherwise have matched, but none of them survived
+	// scope intersection - surface that distinctly so the caller knows to blame the
+	// token's scope rather than a missing role binding.
+	if len(scopes) > 0 && len(rulesToCheck) < len(allRules) {
+		for _, rule := range allRules {
+			if matches, err := attributes.RuleMatches(rule); err == nil && matches {
+				return false, fmt.Sprintf("scope %q does not permit this action", strings.Join(scopes, ",")), ruleRetrievalError
+			}
+		}
+	}
+
 	if len(errs) == 0 {
 		return false, "", ruleRetrievalError
 	}
@@ -132,6 +387,150 @@ func (a *openshiftAuthorizer) authorizeWithNamespaceRules(user user.Info, namesp
 	return false, "", kerrors.NewAggregate(errs)
 }
 
+// BatchDecision pairs one requested Action with its authorization result, preserving
+// the order of the actions slice passed to AuthorizeBatch so callers can zip the
+// results back up with whatever they built the batch from.
+type BatchDecision struct {
+	Action  Action
+	Allowed bool
+	Reason  string
+	Err     error
+}
+
+// AuthorizeBatch evaluates every action in actions against the same resolved rule
+// set, rather than calling Authorize in a loop: RulesFor and scope resolution - the
+// dominant cost when a UI asks "which of these N actions can the user take" - run
+// exactly once regardless of how many actions are in the batch.
+func (a *openshiftAuthorizer) AuthorizeBatch(ctx kapi.Context, actions []Action) []BatchDecision {
+	decisions := make([]BatchDecision, len(actions))
+
+	user, ok := kapi.UserFrom(ctx)
+	if !ok {
+		err := errors.New("no user available on context")
+		for i, action := range actions {
+			decisions[i] = BatchDecision{Action: action, Err: err}
+		}
+		return decisions
+	}
+	namespace, _ := kapi.NamespaceFrom(ctx)
+
+	allRules, ruleRetrievalError := a.ruleResolver.RulesFor(user, namespace)
+	rulesToCheck := allRules
+	scopes := user.GetExtra()[authorizationapi.ScopesKey]
+	if len(scopes) > 0 {
+		if scopedRules, err := a.scopeLimitedRules(scopes, namespace, allRules); err != nil {
+			ruleRetrievalError = err
+			rulesToCheck = nil
+		} else {
+			rulesToCheck = scopedRules
+		}
+	}
+
+	// bulk "can I do any of these" callers frequently repeat the same attributes
+	// (e.g. the same verb/resource checked once per namespace in a list view) - cache
+	// by the coerced attributes so repeats skip straight to the cached decision.
+	seen := map[string]BatchDecision{}
+	for i, action := range actions {
+		attributes := CoerceToDefaultAuthorizationAttributes(action)
+		key := attributesCacheKey(attributes)
+		if cached, ok := seen[key]; ok {
+			cached.Action = action
+			decisions[i] = cached
+			continue
+		}
+
+		allowed, reason, err := evaluateRules(rulesToCheck, allRules, scopes, namespace, attributes, ruleRetrievalError)
+		if !allowed && err == nil && len(reason) == 0 {
+			denyReason, msgErr := a.forbiddenMessageMaker.MakeMessage(MessageContext{user, namespace, attributes})
+			if msgErr != nil {
+				denyReason = msgErr.Error()
+			}
+			reason = denyReason
+		}
+
+		decision := BatchDecision{Action: action, Allowed: allowed, Reason: reason, Err: err}
+		decisions[i] = decision
+		seen[key] = decision
+	}
+	return decisions
+}
+
+// attributesCacheKey builds a comparable key out of the fields that actually drive
+// RuleMatches, so AuthorizeBatch can dedup repeated actions without assuming
+// RequestAttributes (whose concrete type callers control) is itself comparable.
+func attributesCacheKey(attributes *DefaultAuthorizationAttributes) string {
+	return strings.Join([]string{
+		attributes.APIGroup,
+		attributes.Verb,
+		attributes.Resource,
+		attributes.ResourceName,
+		strconv.FormatBool(attributes.NonResourceURL),
+		attributes.URL,
+	}, "\x00")
+}
+
+// SubjectsBatchResult pairs one requested Action with the subjects GetAllowedSubjects
+// would have returned for it.
+type SubjectsBatchResult struct {
+	Action Action
+	Users  sets.String
+	Groups sets.String
+	Err    error
+}
+
+// GetAllowedSubjectsBatch evaluates GetAllowedSubjects for every action in actions
+// against the same fetched role bindings, instead of calling GetRoleBindings(namespace)
+// once per action.
+func (a *openshiftAuthorizer) GetAllowedSubjectsBatch(ctx kapi.Context, actions []Action) []SubjectsBatchResult {
+	results := make([]SubjectsBatchResult, len(actions))
+	namespace, _ := kapi.NamespaceFrom(ctx)
+
+	var scopes []string
+	if callingUser, ok := kapi.UserFrom(ctx); ok {
+		scopes = callingUser.GetExtra()[authorizationapi.ScopesKey]
+	}
+
+	roleBindings, err := a.ruleResolver.GetRoleBindings(namespace)
+
+	for i, action := range actions {
+		users, groups, actionErr := a.subjectsForRoleBindings(roleBindings, err, namespace, scopes, action)
+		results[i] = SubjectsBatchResult{Action: action, Users: users, Groups: groups, Err: actionErr}
+	}
+	return results
+}
+
+// scopeLimitedRules resolves scopes (and, degenerately, the FullScope escape hatch)
+// to the PolicyRules they grant, then narrows allRules down to the subset also
+// covered by that set.  It is used both to limit what a scoped user can do (the
+// forward check) and to limit what a scoped caller can learn about who else can do
+// something (the reverse check in getAllowedSubjectsFromNamespaceBindings).
+func (a *openshiftAuthorizer) scopeLimitedRules(scopes []string, namespace string, allRules []authorizationapi.PolicyRule) ([]authorizationapi.PolicyRule, error) {
+	scopeRules := []authorizationapi.PolicyRule{}
+	var errs []error
+	for _, scope := range scopes {
+		if scope == FullScope {
+			return allRules, nil
+		}
+		rules, err := a.scopeEvaluator.Resolve(scope, namespace)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		scopeRules = append(scopeRules, rules...)
+	}
+	if len(errs) > 0 {
+		return nil, kerrors.NewAggregate(errs)
+	}
+
+	limitedRules := []authorizationapi.PolicyRule{}
+	for _, rule := range allRules {
+		if rulevalidation.Covers(scopeRules, []authorizationapi.PolicyRule{rule}) {
+			limitedRules = append(limitedRules, rule)
+		}
+	}
+	return limitedRules, nil
+}
+
 // TODO this may or may not be the behavior we want for managing rules.  As a for instance, a verb might be specified
 // that our attributes builder will never satisfy.  For now, I think gets us close.  Maybe a warning message of some kind?
 func CoerceToDefaultAuthorizationAttributes(passedAttributes Action) *DefaultAuthorizationAttributes {
@@ -165,8 +564,28 @@ func doesApplyToUser(ruleUsers, ruleGroups sets.String, user user.Info) bool {
 	return false
 }
 
+// rulesForUserAndCluster returns every PolicyRule userInfo holds in namespace,
+// merged with their cluster-scoped (namespace "") rules. RulesFor(user, namespace)
+// alone doesn't surface rights userInfo holds only through a ClusterRoleBinding, so
+// callers comparing the full set of what a user can do - such as the privilege
+// escalation check below - must consult both scopes.
+func rulesForUserAndCluster(ruleResolver rulevalidation.AuthorizationRuleResolver, userInfo user.Info, namespace string) ([]authorizationapi.PolicyRule, error) {
+	rules, err := ruleResolver.RulesFor(userInfo, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if len(namespace) == 0 {
+		return rules, nil
+	}
+	clusterRules, err := ruleResolver.RulesFor(userInfo, "")
+	if err != nil {
+		return nil, err
+	}
+	return append(rules, clusterRules...), nil
+}
+
 // ComputeActingUser fills a user.Info data structure for acting-as scenario
-func ComputeActingUser(subjects []kapi.ObjectReference, groupsSpecified bool, authorizationScopes []string, ctx kapi.Context, groupCache *usercache.GroupCache, auth Authorizer) (*user.DefaultInfo, *DefaultAuthorizationAttributes, error) {
+func ComputeActingUser(subjects []kapi.ObjectReference, groupsSpecified bool, authorizationScopes []string, allowPrivilegeEscalation bool, ctx kapi.Context, groupCache *usercache.GroupCache, ruleResolver rulevalidation.AuthorizationRuleResolver, auth Authorizer) (*user.DefaultInfo, *DefaultAuthorizationAttributes, error) {
 	// make sure we're allowed to impersonate each subject.  While we're iterating through, start building username
 	// and group information
 	username := ""
@@ -245,10 +664,42 @@ func ComputeActingUser(subjects []kapi.ObjectReference, groupsSpecified bool, au
 		extra = map[string][]string{authorizationapi.ScopesKey: authorizationScopes}
 	}
 
-	return &user.DefaultInfo{
+	actingAsUser := &user.DefaultInfo{
 		Name:   username,
 		Groups: groups,
 		Extra:  extra,
-	}, nil, nil
+	}
+
+	actor, ok := kapi.UserFrom(ctx)
+	if !ok {
+		return nil, nil, errors.New("no actor available on context")
+	}
+	namespace, _ := kapi.NamespaceFrom(ctx)
+
+	// being granted "impersonate" on a subject is not enough on its own: without this
+	// check a user with a narrow role that nonetheless includes "impersonate" could
+	// act as a subject with broader permissions than the user actually holds.  Refuse
+	// the impersonation unless the acting user's own rules already cover everything
+	// the subject can do.
+	checkedCoverage := "coverage check skipped: allowPrivilegeEscalation"
+	if !allowPrivilegeEscalation {
+		actorRules, err := rulesForUserAndCluster(ruleResolver, actor, namespace)
+		if err != nil {
+			return nil, nil, err
+		}
+		subjectRules, err := rulesForUserAndCluster(ruleResolver, actingAsUser, namespace)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !rulevalidation.Covers(actorRules, subjectRules) {
+			return nil, nil, fmt.Errorf("user %q cannot act as %q: doing so would escalate privileges in namespace %q", actor.GetName(), username, namespace)
+		}
+		checkedCoverage = "coverage check enforced"
+	}
+
+	// log every successful impersonation, including the escape-hatch path, since that
+	// is exactly the path where a coverage check was skipped and visibility matters most.
+	glog.V(2).Infof("audit: user %q is impersonating %q in namespace %q (%s)", actor.GetName(), username, namespace, checkedCoverage)
 
+	return actingAsUser, nil, nil
 }
@@ -0,0 +1,365 @@
+package authorizer
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/auth/user"
+	"k8s.io/kubernetes/pkg/util/sets"
+	"k8s.io/kubernetes/pkg/watch"
+
+	authorizationapi "github.com/openshift/origin/pkg/authorization/api"
+	"github.com/openshift/origin/pkg/authorization/rulevalidation"
+	userapi "github.com/openshift/origin/pkg/user/api"
+	usercache "github.com/openshift/origin/pkg/user/cache"
+)
+
+// fakeRuleResolver returns canned rules keyed by username and namespace, so
+// tests can give an actor and a subject independently-controlled
+// namespace-scoped and cluster-scoped ("") rule sets. roleBindings backs
+// GetRoleBindings/GetRole for the tests that need provenance, leaving it
+// empty reproduces the old RulesFor-only stub.
+type fakeRuleResolver struct {
+	rules        map[string][]authorizationapi.PolicyRule
+	roleBindings []fakeRoleBinding
+}
+
+func (f *fakeRuleResolver) RulesFor(u user.Info, namespace string) ([]authorizationapi.PolicyRule, error) {
+	return f.rules[u.GetName()+"|"+namespace], nil
+}
+
+func (f *fakeRuleResolver) GetRoleBindings(namespace string) ([]rulevalidation.RoleBinding, error) {
+	bindings := make([]rulevalidation.RoleBinding, 0, len(f.roleBindings))
+	for _, b := range f.roleBindings {
+		bindings = append(bindings, b)
+	}
+	return bindings, nil
+}
+
+func (f *fakeRuleResolver) GetRole(binding rulevalidation.RoleBinding) (rulevalidation.Role, error) {
+	b, ok := binding.(fakeRoleBinding)
+	if !ok {
+		return nil, fmt.Errorf("unexpected RoleBinding type %T", binding)
+	}
+	return b.role, nil
+}
+
+// fakeRole and fakeRoleBinding are the minimal rulevalidation.Role/RoleBinding
+// implementations findMatchingRoleBinding and GetAllowedSubjectsWithProvenance
+// need to report provenance for a match.
+type fakeRole struct {
+	name  string
+	rules []authorizationapi.PolicyRule
+}
+
+func (r fakeRole) Name() string                         { return r.name }
+func (r fakeRole) Rules() []authorizationapi.PolicyRule { return r.rules }
+
+type fakeRoleBinding struct {
+	name   string
+	role   fakeRole
+	users  sets.String
+	groups sets.String
+}
+
+func (b fakeRoleBinding) Name() string        { return b.name }
+func (b fakeRoleBinding) Users() sets.String  { return b.users }
+func (b fakeRoleBinding) Groups() sets.String { return b.groups }
+
+// fakeScopeEvaluator resolves each scope to a fixed rule set from a map, so
+// tests can control exactly what a scope grants without a real role lookup.
+type fakeScopeEvaluator struct {
+	rules map[string][]authorizationapi.PolicyRule
+}
+
+func (f *fakeScopeEvaluator) Resolve(scope, namespace string) ([]authorizationapi.PolicyRule, error) {
+	return f.rules[scope], nil
+}
+
+// fakeForbiddenMessageMaker stands in for the real reason-formatting
+// ForbiddenMessageMaker; tests that reach it only care that a deny without a
+// more specific reason still comes back with something non-empty.
+type fakeForbiddenMessageMaker struct{}
+
+func (fakeForbiddenMessageMaker) MakeMessage(ctx MessageContext) (string, error) {
+	return "denied for test", nil
+}
+
+// fakeImpersonateAuthorizer always grants "impersonate", so ComputeActingUser's
+// privilege-escalation check - which runs after the impersonate check succeeds -
+// is what's actually under test.
+type fakeImpersonateAuthorizer struct{}
+
+func (fakeImpersonateAuthorizer) Authorize(ctx kapi.Context, a Action) (bool, string, error) {
+	return true, "allowed for test", nil
+}
+
+func (fakeImpersonateAuthorizer) GetAllowedSubjects(ctx kapi.Context, a Action) (sets.String, sets.String, error) {
+	return sets.String{}, sets.String{}, nil
+}
+
+type fakeGroupSource struct{}
+
+func (fakeGroupSource) ListGroups(ctx kapi.Context, options *kapi.ListOptions) (*userapi.GroupList, error) {
+	return &userapi.GroupList{}, nil
+}
+func (fakeGroupSource) GetGroup(ctx kapi.Context, name string) (*userapi.Group, error) {
+	return nil, nil
+}
+func (fakeGroupSource) CreateGroup(ctx kapi.Context, group *userapi.Group) (*userapi.Group, error) {
+	return nil, nil
+}
+func (fakeGroupSource) UpdateGroup(ctx kapi.Context, group *userapi.Group) (*userapi.Group, error) {
+	return nil, nil
+}
+func (fakeGroupSource) DeleteGroup(ctx kapi.Context, name string) error {
+	return nil
+}
+func (fakeGroupSource) WatchGroups(ctx kapi.Context, options *kapi.ListOptions) (watch.Interface, error) {
+	return watch.NewFake(), nil
+}
+
+func TestComputeActingUserPrivilegeEscalation(t *testing.T) {
+	namespace := "ns1"
+	broadClusterRule := authorizationapi.PolicyRule{Verbs: []string{"*"}, APIGroups: []string{"*"}, Resources: []string{"*"}}
+	narrowImpersonateRule := authorizationapi.PolicyRule{
+		Verbs:     []string{"impersonate"},
+		APIGroups: []string{userapi.GroupName},
+		Resources: []string{authorizationapi.UserResource},
+	}
+
+	subject := kapi.ObjectReference{Kind: authorizationapi.UserKind, Name: "bob"}
+
+	testcases := map[string]struct {
+		resolver    *fakeRuleResolver
+		expectError bool
+	}{
+		"actor with only namespace-scoped impersonate cannot act as a subject whose broader rights come from a cluster role": {
+			resolver: &fakeRuleResolver{rules: map[string][]authorizationapi.PolicyRule{
+				"alice|" + namespace: {narrowImpersonateRule},
+				"alice|":             {},
+				"bob|" + namespace:   {},
+				"bob|":               {broadClusterRule},
+			}},
+			expectError: true,
+		},
+		"actor whose own rules already cover the subject's rights may act as them": {
+			resolver: &fakeRuleResolver{rules: map[string][]authorizationapi.PolicyRule{
+				"alice|" + namespace: {narrowImpersonateRule, broadClusterRule},
+				"alice|":             {broadClusterRule},
+				"bob|" + namespace:   {},
+				"bob|":               {broadClusterRule},
+			}},
+			expectError: false,
+		},
+	}
+
+	for testName, testcase := range testcases {
+		groupCache := usercache.NewGroupCache(fakeGroupSource{})
+		ctx := kapi.WithUser(kapi.WithNamespace(kapi.NewContext(), namespace), &user.DefaultInfo{Name: "alice"})
+
+		_, _, err := ComputeActingUser([]kapi.ObjectReference{subject}, true, nil, false, ctx, groupCache, testcase.resolver, fakeImpersonateAuthorizer{})
+		if testcase.expectError && err == nil {
+			t.Errorf("%s - expected a privilege-escalation error, got none", testName)
+		}
+		if !testcase.expectError && err != nil {
+			t.Errorf("%s - unexpected error: %v", testName, err)
+		}
+	}
+}
+
+func TestAuthorizeScopeEnforcement(t *testing.T) {
+	namespace := "ns1"
+	listPodsRule := authorizationapi.PolicyRule{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"pods"}}
+	getPodsRule := authorizationapi.PolicyRule{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}}
+
+	resolver := &fakeRuleResolver{rules: map[string][]authorizationapi.PolicyRule{
+		"alice|" + namespace: {listPodsRule},
+		"alice|":             {},
+	}}
+	action := &DefaultAuthorizationAttributes{Verb: "list", Resource: "pods"}
+
+	testcases := map[string]struct {
+		scopes               []string
+		scopeRules           map[string][]authorizationapi.PolicyRule
+		expectAllowed        bool
+		expectReasonContains string
+	}{
+		"scope that doesn't cover the rule is denied with a scope-specific reason": {
+			scopes:               []string{"role:view:ns1"},
+			scopeRules:           map[string][]authorizationapi.PolicyRule{"role:view:ns1": {getPodsRule}},
+			expectAllowed:        false,
+			expectReasonContains: `scope "role:view:ns1" does not permit this action`,
+		},
+		"scope covering the rule allows it": {
+			scopes:        []string{"role:view:ns1"},
+			scopeRules:    map[string][]authorizationapi.PolicyRule{"role:view:ns1": {listPodsRule}},
+			expectAllowed: true,
+		},
+		"FullScope skips scope intersection entirely": {
+			scopes:        []string{FullScope},
+			scopeRules:    map[string][]authorizationapi.PolicyRule{},
+			expectAllowed: true,
+		},
+	}
+
+	for testName, testcase := range testcases {
+		auth := NewAuthorizer(resolver, fakeForbiddenMessageMaker{}, &fakeScopeEvaluator{rules: testcase.scopeRules})
+		actingUser := &user.DefaultInfo{Name: "alice", Extra: map[string][]string{authorizationapi.ScopesKey: testcase.scopes}}
+		ctx := kapi.WithUser(kapi.WithNamespace(kapi.NewContext(), namespace), actingUser)
+
+		allowed, reason, err := auth.Authorize(ctx, action)
+		if err != nil {
+			t.Errorf("%s - unexpected error: %v", testName, err)
+			continue
+		}
+		if allowed != testcase.expectAllowed {
+			t.Errorf("%s - expected allowed=%v, got %v (reason: %q)", testName, testcase.expectAllowed, allowed, reason)
+		}
+		if len(testcase.expectReasonContains) > 0 && !strings.Contains(reason, testcase.expectReasonContains) {
+			t.Errorf("%s - expected reason to contain %q, got %q", testName, testcase.expectReasonContains, reason)
+		}
+	}
+}
+
+func TestAuthorizeWithDecisionProvenance(t *testing.T) {
+	namespace := "ns1"
+	listPodsRule := authorizationapi.PolicyRule{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"pods"}}
+
+	resolver := &fakeRuleResolver{
+		rules: map[string][]authorizationapi.PolicyRule{"alice|" + namespace: {listPodsRule}},
+		roleBindings: []fakeRoleBinding{
+			{
+				name:  "view-binding",
+				role:  fakeRole{name: "view", rules: []authorizationapi.PolicyRule{listPodsRule}},
+				users: sets.NewString("alice"),
+			},
+		},
+	}
+	auth := &openshiftAuthorizer{resolver, fakeForbiddenMessageMaker{}, &fakeScopeEvaluator{}}
+	ctx := kapi.WithUser(kapi.WithNamespace(kapi.NewContext(), namespace), &user.DefaultInfo{Name: "alice"})
+
+	allowedDecision, err := auth.AuthorizeWithDecision(ctx, &DefaultAuthorizationAttributes{Verb: "list", Resource: "pods"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !allowedDecision.Allowed {
+		t.Fatalf("expected the action to be allowed, got denied: %q", allowedDecision.Reason)
+	}
+	if allowedDecision.Role != "view" || allowedDecision.RoleBinding != "view-binding" || allowedDecision.MatchingRoleNamespace != namespace {
+		t.Errorf("expected provenance from role %q / binding %q in %q, got role %q / binding %q in %q",
+			"view", "view-binding", namespace, allowedDecision.Role, allowedDecision.RoleBinding, allowedDecision.MatchingRoleNamespace)
+	}
+	if allowedDecision.MatchingRule == nil {
+		t.Errorf("expected a matching rule to be reported")
+	}
+
+	deniedDecision, err := auth.AuthorizeWithDecision(ctx, &DefaultAuthorizationAttributes{Verb: "delete", Resource: "pods"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if deniedDecision.Allowed {
+		t.Fatalf("expected the action to be denied")
+	}
+	if len(deniedDecision.Role) > 0 || len(deniedDecision.RoleBinding) > 0 {
+		t.Errorf("expected no provenance on a denied decision, got role %q / binding %q", deniedDecision.Role, deniedDecision.RoleBinding)
+	}
+}
+
+func TestGetAllowedSubjectsWithProvenance(t *testing.T) {
+	namespace := "ns1"
+	listPodsRule := authorizationapi.PolicyRule{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"pods"}}
+
+	resolver := &fakeRuleResolver{
+		roleBindings: []fakeRoleBinding{
+			{
+				name:   "view-binding",
+				role:   fakeRole{name: "view", rules: []authorizationapi.PolicyRule{listPodsRule}},
+				users:  sets.NewString("alice"),
+				groups: sets.NewString("viewers"),
+			},
+		},
+	}
+	auth := &openshiftAuthorizer{resolver, fakeForbiddenMessageMaker{}, &fakeScopeEvaluator{}}
+	ctx := kapi.WithNamespace(kapi.NewContext(), namespace)
+
+	results, err := auth.GetAllowedSubjectsWithProvenance(ctx, &DefaultAuthorizationAttributes{Verb: "list", Resource: "pods"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected exactly one SubjectProvenance, got %d", len(results))
+	}
+	result := results[0]
+	if result.Role != "view" || result.RoleBinding != "view-binding" {
+		t.Errorf("expected provenance from role %q / binding %q, got role %q / binding %q", "view", "view-binding", result.Role, result.RoleBinding)
+	}
+	if !result.Users.Has("alice") || !result.Groups.Has("viewers") {
+		t.Errorf("expected users {alice} and groups {viewers}, got users %v groups %v", result.Users.List(), result.Groups.List())
+	}
+}
+
+func TestAuthorizeBatch(t *testing.T) {
+	namespace := "ns1"
+	listPodsRule := authorizationapi.PolicyRule{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"pods"}}
+
+	resolver := &fakeRuleResolver{rules: map[string][]authorizationapi.PolicyRule{
+		"alice|" + namespace: {listPodsRule},
+		"alice|":             {},
+	}}
+	auth := &openshiftAuthorizer{resolver, fakeForbiddenMessageMaker{}, &fakeScopeEvaluator{}}
+	ctx := kapi.WithUser(kapi.WithNamespace(kapi.NewContext(), namespace), &user.DefaultInfo{Name: "alice"})
+
+	listPods := &DefaultAuthorizationAttributes{Verb: "list", Resource: "pods"}
+	deletePods := &DefaultAuthorizationAttributes{Verb: "delete", Resource: "pods"}
+	decisions := auth.AuthorizeBatch(ctx, []Action{listPods, deletePods, listPods})
+
+	if len(decisions) != 3 {
+		t.Fatalf("expected 3 decisions, got %d", len(decisions))
+	}
+	if !decisions[0].Allowed || decisions[0].Action != Action(listPods) {
+		t.Errorf("expected decision 0 to allow the original listPods action, got %+v", decisions[0])
+	}
+	if decisions[1].Allowed {
+		t.Errorf("expected decision 1 (delete) to be denied, got %+v", decisions[1])
+	}
+	// the repeated listPods action (index 2) must come back with the same
+	// verdict as index 0 even though it's served from AuthorizeBatch's
+	// internal dedup cache rather than re-evaluated.
+	if decisions[2].Allowed != decisions[0].Allowed || decisions[2].Reason != decisions[0].Reason {
+		t.Errorf("expected the repeated action to match the first decision, got %+v vs %+v", decisions[2], decisions[0])
+	}
+}
+
+func TestGetAllowedSubjectsBatch(t *testing.T) {
+	namespace := "ns1"
+	listPodsRule := authorizationapi.PolicyRule{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"pods"}}
+
+	resolver := &fakeRuleResolver{
+		roleBindings: []fakeRoleBinding{
+			{
+				name:  "view-binding",
+				role:  fakeRole{name: "view", rules: []authorizationapi.PolicyRule{listPodsRule}},
+				users: sets.NewString("alice"),
+			},
+		},
+	}
+	auth := &openshiftAuthorizer{resolver, fakeForbiddenMessageMaker{}, &fakeScopeEvaluator{}}
+	ctx := kapi.WithNamespace(kapi.NewContext(), namespace)
+
+	listPods := &DefaultAuthorizationAttributes{Verb: "list", Resource: "pods"}
+	deletePods := &DefaultAuthorizationAttributes{Verb: "delete", Resource: "pods"}
+	results := auth.GetAllowedSubjectsBatch(ctx, []Action{listPods, deletePods})
+
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if !results[0].Users.Has("alice") {
+		t.Errorf("expected alice to be an allowed subject for list pods, got %v", results[0].Users.List())
+	}
+	if results[1].Users.Len() > 0 {
+		t.Errorf("expected no allowed subjects for delete pods, got %v", results[1].Users.List())
+	}
+}
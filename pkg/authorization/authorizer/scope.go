@@ -0,0 +1,58 @@
+package authorizer
+
+import (
+	"fmt"
+	"strings"
+
+	authorizationapi "github.com/openshift/origin/pkg/authorization/api"
+	userapi "github.com/openshift/origin/pkg/user/api"
+)
+
+// well-known informational scopes.  They never grant access to cluster resources,
+// only to information about the user the token was issued to.
+const (
+	ScopeUserInfo        = "user:info"
+	ScopeUserAccessCheck = "user:access-check"
+)
+
+// RoleRuleGetter looks up the rules a named role grants, so "role:<name>:<namespace>"
+// scopes can be resolved without giving the scope evaluator the whole rule resolver.
+type RoleRuleGetter interface {
+	GetRoleRules(roleNamespace, roleName string) ([]authorizationapi.PolicyRule, error)
+}
+
+// DefaultScopeEvaluator understands the scopes OpenShift issues out of the box: the
+// fixed "user:*" informational scopes, and "role:<name>:<namespace>" scopes that
+// delegate to a role's own rules.
+type DefaultScopeEvaluator struct {
+	roles RoleRuleGetter
+}
+
+func NewDefaultScopeEvaluator(roles RoleRuleGetter) *DefaultScopeEvaluator {
+	return &DefaultScopeEvaluator{roles: roles}
+}
+
+func (e *DefaultScopeEvaluator) Resolve(scope, namespace string) ([]authorizationapi.PolicyRule, error) {
+	switch scope {
+	case ScopeUserInfo:
+		return []authorizationapi.PolicyRule{
+			{Verbs: []string{"get"}, APIGroups: []string{userapi.GroupName}, Resources: []string{"users"}, ResourceNames: []string{"~"}},
+		}, nil
+
+	case ScopeUserAccessCheck:
+		return []authorizationapi.PolicyRule{
+			{Verbs: []string{"create"}, APIGroups: []string{authorizationapi.GroupName}, Resources: []string{"selfsubjectaccessreviews", "localselfsubjectaccessreviews"}},
+		}, nil
+	}
+
+	if !strings.HasPrefix(scope, "role:") {
+		return nil, fmt.Errorf("no scope evaluator found for %q", scope)
+	}
+
+	parts := strings.Split(scope, ":")
+	if len(parts) != 3 || len(parts[1]) == 0 || len(parts[2]) == 0 {
+		return nil, fmt.Errorf("malformed scope %q, expected role:<name>:<namespace>", scope)
+	}
+	roleName, roleNamespace := parts[1], parts[2]
+	return e.roles.GetRoleRules(roleNamespace, roleName)
+}
@@ -2,17 +2,21 @@ package podsecuritypolicyreview
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/golang/glog"
 
 	kapi "k8s.io/kubernetes/pkg/api"
 	kapierrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/auth/user"
 	clientset "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	"k8s.io/kubernetes/pkg/labels"
 	"k8s.io/kubernetes/pkg/runtime"
 	kscc "k8s.io/kubernetes/pkg/securitycontextconstraints"
 	"k8s.io/kubernetes/pkg/serviceaccount"
 	kerrors "k8s.io/kubernetes/pkg/util/errors"
 
+	"github.com/openshift/origin/pkg/authorization/authorizer"
 	oscache "github.com/openshift/origin/pkg/client/cache"
 	securityapi "github.com/openshift/origin/pkg/security/api"
 	securityvalidation "github.com/openshift/origin/pkg/security/api/validation"
@@ -22,14 +26,15 @@ import (
 
 // REST implements the RESTStorage interface in terms of an Registry.
 type REST struct {
+	authorizer authorizer.Authorizer
 	sccMatcher oscc.SCCMatcher
 	saCache    oscache.StoreToServiceAccountLister
 	client     clientset.Interface
 }
 
 // NewREST creates a new REST for policies..
-func NewREST(m oscc.SCCMatcher, saCache oscache.StoreToServiceAccountLister, c clientset.Interface) *REST {
-	return &REST{sccMatcher: m, saCache: saCache, client: c}
+func NewREST(a authorizer.Authorizer, m oscc.SCCMatcher, saCache oscache.StoreToServiceAccountLister, c clientset.Interface) *REST {
+	return &REST{authorizer: a, sccMatcher: m, saCache: saCache, client: c}
 }
 
 // New creates a new PodSecurityPolicyReview object
@@ -64,12 +69,42 @@ func (r *REST) Create(ctx kapi.Context, obj runtime.Object) (runtime.Object, err
 	newStatus := securityapi.PodSecurityPolicyReviewStatus{}
 	for _, sa := range serviceAccounts {
 		userInfo := serviceaccount.UserInfo(ns, sa.Name, "")
-		saConstraints, err := r.sccMatcher.FindApplicableSCCs(userInfo)
+		matchedConstraints, err := r.sccMatcher.FindApplicableSCCs(userInfo)
 		if err != nil {
 			errs = append(errs, fmt.Errorf("unable to find SecurityContextConstraints for ServiceAccount %s: %v", sa.Name, err))
 			continue
 		}
-		assigner := newSCCAssigner(&newStatus, pspr.Spec.Template.Spec, sa.Name)
+		// The request asks that every candidate - including ones that matched
+		// statically via the SCC's own Users/Groups list - be filtered down to
+		// what RBAC actually authorizes "use" of, so the review reflects what
+		// admission would really permit. That is a real behavior change for
+		// SCCs granted only through the legacy Users/Groups list (e.g. `oc adm
+		// policy add-scc-to-user`) with no corresponding role binding: such a
+		// grant will no longer show up here unless it's backed by RBAC. We
+		// apply the filter as specified rather than quietly keeping the old,
+		// wider behavior; if that legacy path still needs to work, it needs an
+		// equivalent role binding, not a carve-out in this filter.
+		saConstraints, err := r.authorizedSCCs(ctx, ns, userInfo, matchedConstraints)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to authorize statically-matched SecurityContextConstraints for ServiceAccount %s: %v", sa.Name, err))
+			saConstraints = nil
+		}
+		// a constraint doesn't have to match the ServiceAccount's users/groups to be
+		// usable by it - a role binding granting "use" on the named SCC is just as
+		// good, so union in whatever RBAC additionally permits.
+		rbacConstraints, err := r.constraintsUsableViaRBAC(ctx, ns, userInfo)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to determine RBAC-granted SecurityContextConstraints for ServiceAccount %s: %v", sa.Name, err))
+		} else {
+			saConstraints = append(saConstraints, rbacConstraints...)
+		}
+		oscc.DeduplicateSecurityContextConstraints(saConstraints)
+		// sort the survivors the way admission would pick among them: the most
+		// restrictive constraint first, so AllowedServiceAccounts[0] for this
+		// ServiceAccount is deterministically the one admission would also choose.
+		sort.Sort(byRestrictiveness(saConstraints))
+
+		assigner := newSCCAssigner(&newStatus, pspr.Spec.Template.Spec, sa.Name, constraintNames(saConstraints), pspr.Spec.ReturnMutatedPodSpec)
 		err = oscc.AssignConstraints(r.sccMatcher, saConstraints, ns, r.client, assigner)
 		if err != nil {
 			errs = append(errs, fmt.Errorf("unable to assign SecurityContextConstraints for ServiceAccount %s: %v", sa.Name, err))
@@ -84,13 +119,135 @@ func (r *REST) Create(ctx kapi.Context, obj runtime.Object) (runtime.Object, err
 	return pspr, nil
 }
 
+// constraintsUsableViaRBAC returns every SecurityContextConstraints the userInfo is
+// authorized to "use" via a role binding, independent of whether the constraint's own
+// users/groups list would have matched it through r.sccMatcher.
+func (r *REST) constraintsUsableViaRBAC(ctx kapi.Context, ns string, userInfo user.Info) ([]*kapi.SecurityContextConstraints, error) {
+	all, err := r.sccMatcher.SecurityContextConstraints()
+	if err != nil {
+		return nil, err
+	}
+	return r.authorizedSCCs(ctx, ns, userInfo, all)
+}
+
+// authorizedSCCs filters candidates down to those userInfo is authorized to "use",
+// mirroring the SubjectAccessReview the upstream PodSecurityPolicy admission plugin
+// issues for every policy it considers.
+func (r *REST) authorizedSCCs(ctx kapi.Context, ns string, userInfo user.Info, candidates []*kapi.SecurityContextConstraints) ([]*kapi.SecurityContextConstraints, error) {
+	subjectCtx := kapi.WithUser(kapi.WithNamespace(ctx, ns), userInfo)
+	usable := []*kapi.SecurityContextConstraints{}
+	for _, scc := range candidates {
+		useAttributes := &authorizer.DefaultAuthorizationAttributes{
+			Verb:         "use",
+			APIGroup:     securityapi.GroupName,
+			Resource:     "securitycontextconstraints",
+			ResourceName: scc.Name,
+		}
+		allowed, _, err := r.authorizer.Authorize(subjectCtx, useAttributes)
+		if err != nil {
+			return usable, err
+		}
+		if allowed {
+			usable = append(usable, scc)
+		}
+	}
+	return usable, nil
+}
+
+func constraintNames(constraints []*kapi.SecurityContextConstraints) []string {
+	names := make([]string, 0, len(constraints))
+	for _, constraint := range constraints {
+		names = append(names, constraint.Name)
+	}
+	return names
+}
+
+// strategyRestrictiveness ranks the strategy types shared by RunAsUser, SELinuxContext,
+// FSGroup and SupplementalGroups from most to least restrictive: pinning a value (or a
+// range of values) via MustRunAs or MustRunAsRange beats MustRunAsNonRoot, which only
+// rules out root, and both beat RunAsAny, which imposes no constraint at all.
+func strategyRestrictiveness(strategy string) int {
+	switch strategy {
+	case string(kapi.RunAsUserStrategyMustRunAs), string(kapi.RunAsUserStrategyMustRunAsRange), string(kapi.SELinuxStrategyMustRunAs), string(kapi.FSGroupStrategyMustRunAs), string(kapi.SupplementalGroupsStrategyMustRunAs):
+		return 0
+	case string(kapi.RunAsUserStrategyMustRunAsNonRoot):
+		return 1
+	default:
+		// RunAsAny and anything we don't otherwise recognize
+		return 2
+	}
+}
+
+// byRestrictiveness orders constraints the way SCC admission would prefer among
+// several that all apply to the same ServiceAccount: non-privileged before
+// privileged, pinned strategies before RunAsAny, and named (non-wildcard) grants
+// before ones available to every authenticated ServiceAccount. Ties fall back to the
+// constraint's name so the ordering - and therefore AllowedServiceAccounts[0] - is
+// fully deterministic.
+type byRestrictiveness []*kapi.SecurityContextConstraints
+
+func (b byRestrictiveness) Len() int      { return len(b) }
+func (b byRestrictiveness) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byRestrictiveness) Less(i, j int) bool {
+	si, sj := restrictivenessScore(b[i]), restrictivenessScore(b[j])
+	if si != sj {
+		return si < sj
+	}
+	return b[i].Name < b[j].Name
+}
+
+func restrictivenessScore(scc *kapi.SecurityContextConstraints) int {
+	score := 0
+	if scc.AllowPrivilegedContainer {
+		score += 100
+	}
+	if scc.AllowHostNetwork {
+		score += 10
+	}
+	if scc.AllowHostPorts {
+		score += 10
+	}
+	if scc.AllowHostPID {
+		score += 10
+	}
+	if scc.AllowHostIPC {
+		score += 10
+	}
+	score += strategyRestrictiveness(string(scc.RunAsUser.Type))
+	score += strategyRestrictiveness(string(scc.SELinuxContext.Type))
+	score += strategyRestrictiveness(string(scc.FSGroup.Type))
+	score += strategyRestrictiveness(string(scc.SupplementalGroups.Type))
+	if len(scc.Users) == 0 {
+		// granted to a group (or wildcard-like "system:serviceaccounts") rather than
+		// to this ServiceAccount by name - prefer the more narrowly-scoped grant.
+		score += 1
+	}
+	return score
+}
+
+// defaultMaxServiceAccountsPerReview caps how many ServiceAccounts a single
+// AllServiceAccounts review will evaluate when Spec.MaxServiceAccounts isn't
+// set, so an admin auditing a namespace full of workloads can't accidentally
+// trigger an unbounded SCC-matching loop.
+const defaultMaxServiceAccountsPerReview = 250
+
 func getServiceAccounts(psprSpec securityapi.PodSecurityPolicyReviewSpec, saCache oscache.StoreToServiceAccountLister, namespace string) ([]*kapi.ServiceAccount, error) {
 	serviceAccounts := []*kapi.ServiceAccount{}
-	//  TODO: express 'all service accounts'
-	//if serviceAccountList, err := client.Core().ServiceAccounts(namespace).List(kapi.ListOptions{}); err == nil {
-	//	serviceAccounts = serviceAccountList.Items
-	//	return serviceAccounts, fmt.Errorf("unable to retrieve service accounts: %v", err)
-	//}
+
+	if psprSpec.AllServiceAccounts {
+		maxServiceAccounts := psprSpec.MaxServiceAccounts
+		if maxServiceAccounts <= 0 {
+			maxServiceAccounts = defaultMaxServiceAccountsPerReview
+		}
+		all, err := saCache.ServiceAccounts(namespace).List(labels.Everything())
+		if err != nil {
+			return serviceAccounts, fmt.Errorf("unable to retrieve ServiceAccounts for namespace %s: %v", namespace, err)
+		}
+		if len(all) > maxServiceAccounts {
+			return serviceAccounts, fmt.Errorf("namespace %s has %d ServiceAccounts, which exceeds the %d allowed in a single AllServiceAccounts review", namespace, len(all), maxServiceAccounts)
+		}
+		return all, nil
+	}
 
 	if len(psprSpec.ServiceAccountNames) > 0 {
 		errs := []error{}
@@ -116,31 +273,66 @@ func getServiceAccounts(psprSpec securityapi.PodSecurityPolicyReviewSpec, saCach
 }
 
 type sCCAssigner struct {
-	status             *securityapi.PodSecurityPolicyReviewStatus
-	spec               kapi.PodSpec
-	serviceAccountName string
+	status               *securityapi.PodSecurityPolicyReviewStatus
+	spec                 kapi.PodSpec
+	serviceAccountName   string
+	candidateSCCs        []string
+	returnMutatedPodSpec bool
 }
 
 var _ oscc.SCCAssigner = &sCCAssigner{}
 
-func newSCCAssigner(status *securityapi.PodSecurityPolicyReviewStatus, spec kapi.PodSpec, serviceAccountName string) oscc.SCCAssigner {
+func newSCCAssigner(status *securityapi.PodSecurityPolicyReviewStatus, spec kapi.PodSpec, serviceAccountName string, candidateSCCs []string, returnMutatedPodSpec bool) oscc.SCCAssigner {
 	return &sCCAssigner{
-		status:             status,
-		spec:               spec,
-		serviceAccountName: serviceAccountName,
+		status:               status,
+		spec:                 spec,
+		serviceAccountName:   serviceAccountName,
+		candidateSCCs:        candidateSCCs,
+		returnMutatedPodSpec: returnMutatedPodSpec,
 	}
 }
 
+// reasonProviderCreationFailed denies a constraint that AssignConstraints couldn't
+// even build a provider for, before FillPodSecurityPolicySubjectReviewStatus had a
+// chance to set its own, more specific Reason.
+const reasonProviderCreationFailed = "ProviderCreationFailed"
+
 func (a *sCCAssigner) Assign(provider kscc.SecurityContextConstraintsProvider, constraint *kapi.SecurityContextConstraints) error {
+	if provider == nil {
+		a.denyServiceAccount(constraint.Name, reasonProviderCreationFailed, "unable to create a SecurityContextConstraintsProvider for this constraint")
+		return fmt.Errorf("unable to create a SecurityContextConstraintsProvider for constraint %s", constraint.Name)
+	}
 	pspsrs := securityapi.PodSecurityPolicySubjectReviewStatus{}
-	filled, err := podsecuritypolicysubjectreview.FillPodSecurityPolicySubjectReviewStatus(&pspsrs, provider, a.spec, constraint)
+	filled, err := podsecuritypolicysubjectreview.FillPodSecurityPolicySubjectReviewStatus(&pspsrs, provider, a.spec, constraint, a.returnMutatedPodSpec)
 	if !filled || err != nil {
 		if err == nil {
 			err = fmt.Errorf("unknown reason")
 		}
+		reason := pspsrs.Reason
+		if len(reason) == 0 {
+			reason = reasonProviderCreationFailed
+		}
+		a.denyServiceAccount(constraint.Name, reason, err.Error())
 		return fmt.Errorf("unable to fill PodSecurityPolicySubjectReviewStatus from constraint: %v", err)
 	}
-	sapsprs := securityapi.ServiceAccountPodSecurityPolicyReviewStatus{pspsrs, a.serviceAccountName}
+	sapsprs := securityapi.ServiceAccountPodSecurityPolicyReviewStatus{
+		PodSecurityPolicySubjectReviewStatus: pspsrs,
+		Name:                                 a.serviceAccountName,
+		AssignedSCC:                          constraint.Name,
+		CandidateSCCs:                        a.candidateSCCs,
+	}
 	a.status.AllowedServiceAccounts = append(a.status.AllowedServiceAccounts, sapsprs)
 	return nil
 }
+
+// denyServiceAccount records why constraint sccName refused a.serviceAccountName, so
+// callers using this review as a policy-debugging tool can see why a given SCC didn't
+// accept their pod rather than just that it wasn't in AllowedServiceAccounts.
+func (a *sCCAssigner) denyServiceAccount(sccName, reason, message string) {
+	a.status.DeniedServiceAccounts = append(a.status.DeniedServiceAccounts, securityapi.DeniedServiceAccount{
+		Name:    a.serviceAccountName,
+		SCCName: sccName,
+		Reason:  reason,
+		Message: message,
+	})
+}
@@ -1,7 +1,9 @@
 package podsecuritypolicyreview
 
 import (
+	"fmt"
 	"reflect"
+	"sort"
 	"testing"
 
 	kapi "k8s.io/kubernetes/pkg/api"
@@ -9,8 +11,10 @@ import (
 	clientset "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
 	clientsetfake "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset/fake"
 	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util/sets"
 	"k8s.io/kubernetes/pkg/watch"
 
+	"github.com/openshift/origin/pkg/authorization/authorizer"
 	oscache "github.com/openshift/origin/pkg/client/cache"
 	admissionttesting "github.com/openshift/origin/pkg/security/admission/testing"
 	securityapi "github.com/openshift/origin/pkg/security/api"
@@ -19,6 +23,24 @@ import (
 	usercache "github.com/openshift/origin/pkg/user/cache"
 )
 
+// fakeAuthorizer grants "use" on exactly the named SecurityContextConstraints,
+// standing in for a role binding that RBAC-authorizes their use without the
+// constraint's own users/groups matching the caller.
+type fakeAuthorizer struct {
+	allowedSCCs sets.String
+}
+
+func (f *fakeAuthorizer) Authorize(ctx kapi.Context, a authorizer.Action) (bool, string, error) {
+	if a.GetVerb() == "use" && a.GetResource() == "securitycontextconstraints" && f.allowedSCCs.Has(a.GetResourceName()) {
+		return true, "allowed by role binding", nil
+	}
+	return false, "no role binding grants use of this SecurityContextConstraints", nil
+}
+
+func (f *fakeAuthorizer) GetAllowedSubjects(ctx kapi.Context, a authorizer.Action) (sets.String, sets.String, error) {
+	return sets.String{}, sets.String{}, nil
+}
+
 type groupCache struct {
 }
 
@@ -44,9 +66,11 @@ func (*groupCache) WatchGroups(ctx kapi.Context, options *kapi.ListOptions) (wat
 func TestNoErrors(t *testing.T) {
 	var uid int64 = 999
 	testcases := map[string]struct {
-		request    *securityapi.PodSecurityPolicyReview
-		sccs       []*kapi.SecurityContextConstraints
-		allowedSAs []string
+		request     *securityapi.PodSecurityPolicyReview
+		sccs        []*kapi.SecurityContextConstraints
+		allowedSCCs []string
+		allowedSAs  []string
+		deniedSCCs  []string
 	}{
 		"default in pod": {
 			request: &securityapi.PodSecurityPolicyReview{
@@ -83,7 +107,8 @@ func TestNoErrors(t *testing.T) {
 					Groups: []string{"system:serviceaccounts"},
 				},
 			},
-			allowedSAs: []string{"default"},
+			allowedSCCs: []string{"scc-sa"},
+			allowedSAs:  []string{"default"},
 		},
 		"failure creating provider": {
 			request: &securityapi.PodSecurityPolicyReview{
@@ -141,7 +166,91 @@ func TestNoErrors(t *testing.T) {
 					Groups: []string{"system:serviceaccounts"},
 				},
 			},
-			allowedSAs: nil,
+			allowedSCCs: []string{"restrictive"},
+			allowedSAs:  nil,
+			deniedSCCs:  []string{"restrictive"},
+		},
+		"rbac granted, no group match": {
+			request: &securityapi.PodSecurityPolicyReview{
+				Spec: securityapi.PodSecurityPolicyReviewSpec{
+					Template: kapi.PodTemplateSpec{
+						Spec: kapi.PodSpec{
+							Containers:         []kapi.Container{{Name: "ctr", Image: "image", ImagePullPolicy: "IfNotPresent"}},
+							RestartPolicy:      kapi.RestartPolicyAlways,
+							SecurityContext:    &kapi.PodSecurityContext{},
+							DNSPolicy:          kapi.DNSClusterFirst,
+							ServiceAccountName: "default",
+						},
+					},
+				},
+			},
+			sccs: []*kapi.SecurityContextConstraints{
+				{
+					ObjectMeta: kapi.ObjectMeta{
+						SelfLink: "/api/version/securitycontextconstraints/rbac-only",
+						Name:     "rbac-only",
+					},
+					RunAsUser: kapi.RunAsUserStrategyOptions{
+						Type: kapi.RunAsUserStrategyMustRunAsRange,
+					},
+					SELinuxContext: kapi.SELinuxContextStrategyOptions{
+						Type: kapi.SELinuxStrategyMustRunAs,
+					},
+					FSGroup: kapi.FSGroupStrategyOptions{
+						Type: kapi.FSGroupStrategyMustRunAs,
+					},
+					SupplementalGroups: kapi.SupplementalGroupsStrategyOptions{
+						Type: kapi.SupplementalGroupsStrategyMustRunAs,
+					},
+					// deliberately no Users/Groups - only a role binding grants this one
+				},
+			},
+			allowedSCCs: []string{"rbac-only"},
+			allowedSAs:  []string{"default"},
+		},
+		"statically matched but RBAC denies use": {
+			request: &securityapi.PodSecurityPolicyReview{
+				Spec: securityapi.PodSecurityPolicyReviewSpec{
+					Template: kapi.PodTemplateSpec{
+						Spec: kapi.PodSpec{
+							Containers:         []kapi.Container{{Name: "ctr", Image: "image", ImagePullPolicy: "IfNotPresent"}},
+							RestartPolicy:      kapi.RestartPolicyAlways,
+							SecurityContext:    &kapi.PodSecurityContext{},
+							DNSPolicy:          kapi.DNSClusterFirst,
+							ServiceAccountName: "default",
+						},
+					},
+				},
+			},
+			sccs: []*kapi.SecurityContextConstraints{
+				{
+					ObjectMeta: kapi.ObjectMeta{
+						SelfLink: "/api/version/securitycontextconstraints/legacy-scc",
+						Name:     "legacy-scc",
+					},
+					RunAsUser: kapi.RunAsUserStrategyOptions{
+						Type: kapi.RunAsUserStrategyMustRunAsRange,
+					},
+					SELinuxContext: kapi.SELinuxContextStrategyOptions{
+						Type: kapi.SELinuxStrategyMustRunAs,
+					},
+					FSGroup: kapi.FSGroupStrategyOptions{
+						Type: kapi.FSGroupStrategyMustRunAs,
+					},
+					SupplementalGroups: kapi.SupplementalGroupsStrategyOptions{
+						Type: kapi.SupplementalGroupsStrategyMustRunAs,
+					},
+					// granted via the legacy static Groups list, but with no
+					// RoleBinding backing it - fakeAuthorizer below denies "use" on
+					// it, so it's filtered out even though it matched statically.
+					// A grant through this legacy path now requires an equivalent
+					// role binding; there is no carve-out for it here.
+					Groups: []string{"system:serviceaccounts"},
+				},
+			},
+			// deliberately empty: the fakeAuthorizer denies "use" on every SCC here
+			allowedSCCs: []string{},
+			allowedSAs:  nil,
 		},
 	}
 
@@ -160,7 +269,7 @@ func TestNoErrors(t *testing.T) {
 		serviceAccount.Namespace = namespace.Name
 		groupCache := usercache.NewGroupCache(&groupCache{})
 		csf := clientsetfake.NewSimpleClientset(namespace, serviceAccount)
-		storage := REST{oscc.NewDefaultSCCMatcher(cache), groupCache, csf}
+		storage := REST{&fakeAuthorizer{allowedSCCs: sets.NewString(testcase.allowedSCCs...)}, oscc.NewDefaultSCCMatcher(cache), groupCache, csf}
 		ctx := kapi.WithNamespace(kapi.NewContext(), namespace.Name)
 		obj, err := storage.Create(ctx, testcase.request)
 		if err != nil {
@@ -179,6 +288,24 @@ func TestNoErrors(t *testing.T) {
 		if !reflect.DeepEqual(allowedSas, testcase.allowedSAs) {
 			t.Errorf("%s - expected allowed ServiceAccout names %v got %v", testName, testcase.allowedSAs, allowedSas)
 		}
+		for _, allowed := range pspsr.Status.AllowedServiceAccounts {
+			if allowed.AssignedSCC == "" {
+				t.Errorf("%s - allowed ServiceAccount %s has no AssignedSCC", testName, allowed.Name)
+			}
+			if len(allowed.CandidateSCCs) == 0 {
+				t.Errorf("%s - allowed ServiceAccount %s has no CandidateSCCs", testName, allowed.Name)
+			}
+		}
+		var deniedSCCs []string
+		for _, denied := range pspsr.Status.DeniedServiceAccounts {
+			deniedSCCs = append(deniedSCCs, denied.SCCName)
+			if len(denied.Reason) == 0 {
+				t.Errorf("%s - denied ServiceAccount %s is missing a Reason", testName, denied.Name)
+			}
+		}
+		if !reflect.DeepEqual(deniedSCCs, testcase.deniedSCCs) {
+			t.Errorf("%s - expected denied SecurityContextConstraints %v got %v", testName, testcase.deniedSCCs, deniedSCCs)
+		}
 	}
 }
 
@@ -242,7 +369,7 @@ func TestErrors(t *testing.T) {
 			csf = clientsetfake.NewSimpleClientset(namespace)
 		}
 		groupCache := usercache.NewGroupCache(&groupCache{})
-		storage := REST{oscc.NewDefaultSCCMatcher(cache), groupCache, csf}
+		storage := REST{&fakeAuthorizer{allowedSCCs: sets.String{}}, oscc.NewDefaultSCCMatcher(cache), groupCache, csf}
 		ctx := kapi.WithNamespace(kapi.NewContext(), namespace.Name)
 		_, err := storage.Create(ctx, testcase.request)
 		if err == nil {
@@ -259,6 +386,7 @@ func TestSpecificSAs(t *testing.T) {
 	testcases := map[string]struct {
 		request         *securityapi.PodSecurityPolicyReview
 		sccs            []*kapi.SecurityContextConstraints
+		allowedSCCs     []string
 		errorMessage    string
 		serviceAccounts []*kapi.ServiceAccount
 	}{
@@ -283,6 +411,7 @@ func TestSpecificSAs(t *testing.T) {
 					ServiceAccountNames: []string{"my-sa", "yours-sa"},
 				},
 			},
+			allowedSCCs: []string{"myscc"},
 			sccs: []*kapi.SecurityContextConstraints{
 				{
 					ObjectMeta: kapi.ObjectMeta{
@@ -378,6 +507,59 @@ func TestSpecificSAs(t *testing.T) {
 			},
 			errorMessage: `unable to retrieve ServiceAccount bad-sa: ServiceAccount "bad-sa" not found`,
 		},
+		"RBAC-granted SA, no group match": {
+			request: &securityapi.PodSecurityPolicyReview{
+				Spec: securityapi.PodSecurityPolicyReviewSpec{
+					Template: kapi.PodTemplateSpec{
+						Spec: kapi.PodSpec{
+							Containers: []kapi.Container{
+								{
+									Name:            "ctr",
+									Image:           "image",
+									ImagePullPolicy: "IfNotPresent",
+								},
+							},
+							RestartPolicy:      kapi.RestartPolicyAlways,
+							SecurityContext:    &kapi.PodSecurityContext{},
+							DNSPolicy:          kapi.DNSClusterFirst,
+							ServiceAccountName: "default",
+						},
+					},
+					ServiceAccountNames: []string{"my-sa"},
+				},
+			},
+			sccs: []*kapi.SecurityContextConstraints{
+				{
+					ObjectMeta: kapi.ObjectMeta{
+						SelfLink: "/api/version/securitycontextconstraints/rbac-only",
+						Name:     "rbac-only",
+					},
+					RunAsUser: kapi.RunAsUserStrategyOptions{
+						Type: kapi.RunAsUserStrategyMustRunAsRange,
+					},
+					SELinuxContext: kapi.SELinuxContextStrategyOptions{
+						Type: kapi.SELinuxStrategyMustRunAs,
+					},
+					FSGroup: kapi.FSGroupStrategyOptions{
+						Type: kapi.FSGroupStrategyMustRunAs,
+					},
+					SupplementalGroups: kapi.SupplementalGroupsStrategyOptions{
+						Type: kapi.SupplementalGroupsStrategyMustRunAs,
+					},
+					// deliberately no Users/Groups - only a role binding grants this one
+				},
+			},
+			allowedSCCs: []string{"rbac-only"},
+			serviceAccounts: []*kapi.ServiceAccount{
+				{
+					ObjectMeta: kapi.ObjectMeta{
+						Name:      "my-sa",
+						Namespace: "default",
+					},
+				},
+			},
+			errorMessage: "",
+		},
 	}
 
 	for testName, testcase := range testcases {
@@ -398,7 +580,7 @@ func TestSpecificSAs(t *testing.T) {
 		}
 		csf := clientsetfake.NewSimpleClientset(objects...)
 		groupCache := usercache.NewGroupCache(&groupCache{})
-		storage := REST{oscc.NewDefaultSCCMatcher(cache), groupCache, csf}
+		storage := REST{&fakeAuthorizer{allowedSCCs: sets.NewString(testcase.allowedSCCs...)}, oscc.NewDefaultSCCMatcher(cache), groupCache, csf}
 		ctx := kapi.WithNamespace(kapi.NewContext(), namespace.Name)
 		_, err := storage.Create(ctx, testcase.request)
 		switch {
@@ -412,3 +594,203 @@ func TestSpecificSAs(t *testing.T) {
 		}
 	}
 }
+
+func TestReturnMutatedPodSpec(t *testing.T) {
+	scc := &kapi.SecurityContextConstraints{
+		ObjectMeta: kapi.ObjectMeta{
+			SelfLink: "/api/version/securitycontextconstraints/myscc",
+			Name:     "myscc",
+		},
+		RunAsUser: kapi.RunAsUserStrategyOptions{
+			Type: kapi.RunAsUserStrategyMustRunAsRange,
+		},
+		SELinuxContext: kapi.SELinuxContextStrategyOptions{
+			Type: kapi.SELinuxStrategyMustRunAs,
+		},
+		FSGroup: kapi.FSGroupStrategyOptions{
+			Type: kapi.FSGroupStrategyMustRunAs,
+		},
+		SupplementalGroups: kapi.SupplementalGroupsStrategyOptions{
+			Type: kapi.SupplementalGroupsStrategyMustRunAs,
+		},
+		Groups: []string{"system:serviceaccounts"},
+	}
+	// deliberately no ServiceAccountName, so the only way Template.Spec
+	// comes back populated is via ReturnMutatedPodSpec.
+	podTemplate := kapi.PodTemplateSpec{
+		Spec: kapi.PodSpec{
+			Containers:      []kapi.Container{{Name: "ctr", Image: "image", ImagePullPolicy: "IfNotPresent"}},
+			RestartPolicy:   kapi.RestartPolicyAlways,
+			SecurityContext: &kapi.PodSecurityContext{},
+			DNSPolicy:       kapi.DNSClusterFirst,
+		},
+	}
+
+	testcases := map[string]struct {
+		returnMutatedPodSpec bool
+		wantTemplate         bool
+	}{
+		"unset leaves Template.Spec empty when ServiceAccountName is omitted": {
+			returnMutatedPodSpec: false,
+			wantTemplate:         false,
+		},
+		"set returns Template.Spec even though ServiceAccountName is omitted": {
+			returnMutatedPodSpec: true,
+			wantTemplate:         true,
+		},
+	}
+
+	for testName, testcase := range testcases {
+		cache := &oscache.IndexerToSecurityContextConstraintsLister{
+			Indexer: cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+				cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		}
+		if err := cache.Add(scc); err != nil {
+			t.Fatalf("error adding sccs to store: %v", err)
+		}
+		namespace := admissionttesting.CreateNamespaceForTest()
+		serviceAccount := admissionttesting.CreateSAForTest()
+		serviceAccount.Namespace = namespace.Name
+		csf := clientsetfake.NewSimpleClientset(namespace, serviceAccount)
+		groupCache := usercache.NewGroupCache(&groupCache{})
+		storage := REST{&fakeAuthorizer{allowedSCCs: sets.NewString("myscc")}, oscc.NewDefaultSCCMatcher(cache), groupCache, csf}
+		ctx := kapi.WithNamespace(kapi.NewContext(), namespace.Name)
+		request := &securityapi.PodSecurityPolicyReview{
+			Spec: securityapi.PodSecurityPolicyReviewSpec{
+				Template:             podTemplate,
+				ReturnMutatedPodSpec: testcase.returnMutatedPodSpec,
+			},
+		}
+		obj, err := storage.Create(ctx, request)
+		if err != nil {
+			t.Errorf("%s - unexpected error: %v", testName, err)
+			continue
+		}
+		pspsr, ok := obj.(*securityapi.PodSecurityPolicyReview)
+		if !ok {
+			t.Errorf("%s - unable to convert created runtime.Object to PodSecurityPolicyReview", testName)
+			continue
+		}
+		if len(pspsr.Status.AllowedServiceAccounts) != 1 {
+			t.Fatalf("%s - expected exactly one allowed ServiceAccount, got %d", testName, len(pspsr.Status.AllowedServiceAccounts))
+		}
+		hasTemplate := len(pspsr.Status.AllowedServiceAccounts[0].Template.Spec.Containers) > 0
+		if hasTemplate != testcase.wantTemplate {
+			t.Errorf("%s - expected Template.Spec populated=%v, got %v", testName, testcase.wantTemplate, hasTemplate)
+		}
+	}
+}
+
+func TestAllServiceAccounts(t *testing.T) {
+	scc := &kapi.SecurityContextConstraints{
+		ObjectMeta: kapi.ObjectMeta{
+			SelfLink: "/api/version/securitycontextconstraints/myscc",
+			Name:     "myscc",
+		},
+		RunAsUser: kapi.RunAsUserStrategyOptions{
+			Type: kapi.RunAsUserStrategyMustRunAsRange,
+		},
+		SELinuxContext: kapi.SELinuxContextStrategyOptions{
+			Type: kapi.SELinuxStrategyMustRunAs,
+		},
+		FSGroup: kapi.FSGroupStrategyOptions{
+			Type: kapi.FSGroupStrategyMustRunAs,
+		},
+		SupplementalGroups: kapi.SupplementalGroupsStrategyOptions{
+			Type: kapi.SupplementalGroupsStrategyMustRunAs,
+		},
+		Groups: []string{"system:serviceaccounts"},
+	}
+	podTemplate := kapi.PodTemplateSpec{
+		Spec: kapi.PodSpec{
+			Containers:         []kapi.Container{{Name: "ctr", Image: "image", ImagePullPolicy: "IfNotPresent"}},
+			RestartPolicy:      kapi.RestartPolicyAlways,
+			SecurityContext:    &kapi.PodSecurityContext{},
+			DNSPolicy:          kapi.DNSClusterFirst,
+			ServiceAccountName: "default",
+		},
+	}
+
+	testcases := map[string]struct {
+		serviceAccounts    []*kapi.ServiceAccount
+		maxServiceAccounts int
+		errorMessage       string
+		allowedSAs         []string
+	}{
+		"every SA in the namespace is evaluated": {
+			serviceAccounts: []*kapi.ServiceAccount{
+				{ObjectMeta: kapi.ObjectMeta{Name: "my-sa", Namespace: "default"}},
+				{ObjectMeta: kapi.ObjectMeta{Name: "yours-sa", Namespace: "default"}},
+			},
+			allowedSAs: []string{"my-sa", "yours-sa"},
+		},
+		"namespace exceeds the default per-review cap": {
+			serviceAccounts: func() []*kapi.ServiceAccount {
+				sas := make([]*kapi.ServiceAccount, 0, defaultMaxServiceAccountsPerReview+1)
+				for i := 0; i < defaultMaxServiceAccountsPerReview+1; i++ {
+					sas = append(sas, &kapi.ServiceAccount{ObjectMeta: kapi.ObjectMeta{Name: fmt.Sprintf("sa-%d", i), Namespace: "default"}})
+				}
+				return sas
+			}(),
+			errorMessage: fmt.Sprintf("namespace default has %d ServiceAccounts, which exceeds the %d allowed in a single AllServiceAccounts review", defaultMaxServiceAccountsPerReview+1, defaultMaxServiceAccountsPerReview),
+		},
+		"namespace exceeds a caller-configured per-review cap smaller than the default": {
+			serviceAccounts: []*kapi.ServiceAccount{
+				{ObjectMeta: kapi.ObjectMeta{Name: "my-sa", Namespace: "default"}},
+				{ObjectMeta: kapi.ObjectMeta{Name: "yours-sa", Namespace: "default"}},
+			},
+			maxServiceAccounts: 1,
+			errorMessage:       "namespace default has 2 ServiceAccounts, which exceeds the 1 allowed in a single AllServiceAccounts review",
+		},
+	}
+
+	for testName, testcase := range testcases {
+		cache := &oscache.IndexerToSecurityContextConstraintsLister{
+			Indexer: cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+				cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		}
+		if err := cache.Add(scc); err != nil {
+			t.Fatalf("error adding sccs to store: %v", err)
+		}
+		namespace := admissionttesting.CreateNamespaceForTest()
+		objects := []runtime.Object{namespace}
+		for _, sa := range testcase.serviceAccounts {
+			objects = append(objects, sa)
+		}
+		csf := clientsetfake.NewSimpleClientset(objects...)
+		groupCache := usercache.NewGroupCache(&groupCache{})
+		storage := REST{&fakeAuthorizer{allowedSCCs: sets.NewString("myscc")}, oscc.NewDefaultSCCMatcher(cache), groupCache, csf}
+		ctx := kapi.WithNamespace(kapi.NewContext(), namespace.Name)
+		request := &securityapi.PodSecurityPolicyReview{
+			Spec: securityapi.PodSecurityPolicyReviewSpec{
+				Template:           podTemplate,
+				AllServiceAccounts: true,
+				MaxServiceAccounts: testcase.maxServiceAccounts,
+			},
+		}
+		obj, err := storage.Create(ctx, request)
+		if len(testcase.errorMessage) > 0 {
+			if err == nil || err.Error() != testcase.errorMessage {
+				t.Errorf("%s - expected error %q, got %v", testName, testcase.errorMessage, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s - unexpected error: %v", testName, err)
+			continue
+		}
+		pspsr, ok := obj.(*securityapi.PodSecurityPolicyReview)
+		if !ok {
+			t.Errorf("%s - unable to convert created runtime.Object to PodSecurityPolicyReview", testName)
+			continue
+		}
+		var allowedSAs []string
+		for _, sa := range pspsr.Status.AllowedServiceAccounts {
+			allowedSAs = append(allowedSAs, sa.Name)
+		}
+		sort.Strings(allowedSAs)
+		if !reflect.DeepEqual(allowedSAs, testcase.allowedSAs) {
+			t.Errorf("%s - expected allowed ServiceAccount names %v got %v", testName, testcase.allowedSAs, allowedSAs)
+		}
+	}
+}
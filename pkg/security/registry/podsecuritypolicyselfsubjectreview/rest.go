@@ -1,10 +1,13 @@
 package podsecuritypolicyselfsubjectreview
 
 import (
+	"errors"
 	"fmt"
 
+	"k8s.io/kubernetes/pkg/admission"
 	kapi "k8s.io/kubernetes/pkg/api"
 	kapierrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/auth/user"
 	clientset "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
 	"k8s.io/kubernetes/pkg/runtime"
 	kscc "k8s.io/kubernetes/pkg/securitycontextconstraints"
@@ -21,11 +24,12 @@ import (
 type REST struct {
 	sccMatcher oscc.SCCMatcher
 	client     clientset.Interface
+	admission  admission.Interface
 }
 
 // NewREST creates a new REST for policies..
-func NewREST(m oscc.SCCMatcher, c clientset.Interface) *REST {
-	return &REST{sccMatcher: m, client: c}
+func NewREST(m oscc.SCCMatcher, c clientset.Interface, a admission.Interface) *REST {
+	return &REST{sccMatcher: m, client: c, admission: a}
 }
 
 // New creates a new PodSecurityPolicySelfSubjectReview object
@@ -63,34 +67,90 @@ func (r *REST) Create(ctx kapi.Context, obj runtime.Object) (runtime.Object, err
 		}
 		matchedConstraints = append(matchedConstraints, saConstraints...)
 	}
-	assigner := newSCCAssigner(&pspssr.Status, pspssr.Spec.Template.Spec)
-	if err = oscc.AssignConstraints(r.sccMatcher, matchedConstraints, ns, r.client, assigner); err != nil {
+	assigner := newSCCAssigner(&pspssr.Status, pspssr.Spec.Template.Spec, pspssr.Spec.ReturnAll, pspssr.Spec.SkipAdmissionCheck, r.admission, ns, userInfo)
+	if err = oscc.AssignConstraints(r.sccMatcher, matchedConstraints, ns, r.client, assigner); err != nil && err != errContinueSCCEvaluation {
 		glog.V(4).Infof("PodSecurityPolicySelfSubjectReview error: %v", err)
 	}
 	return pspssr, nil
 }
 
 type sCCAssigner struct {
-	status *securityapi.PodSecurityPolicySubjectReviewStatus
-	spec   kapi.PodSpec
+	status             *securityapi.PodSecurityPolicySubjectReviewStatus
+	spec               kapi.PodSpec
+	returnAll          bool
+	skipAdmissionCheck bool
+	admission          admission.Interface
+	namespace          string
+	userInfo           user.Info
 }
 
 var _ oscc.SCCAssigner = &sCCAssigner{}
 
-func newSCCAssigner(status *securityapi.PodSecurityPolicySubjectReviewStatus, spec kapi.PodSpec) oscc.SCCAssigner {
+func newSCCAssigner(status *securityapi.PodSecurityPolicySubjectReviewStatus, spec kapi.PodSpec, returnAll, skipAdmissionCheck bool, admissionControl admission.Interface, namespace string, userInfo user.Info) oscc.SCCAssigner {
 	return &sCCAssigner{
-		status: status,
-		spec:   spec,
+		status:             status,
+		spec:               spec,
+		returnAll:          returnAll,
+		skipAdmissionCheck: skipAdmissionCheck,
+		admission:          admissionControl,
+		namespace:          namespace,
+		userInfo:           userInfo,
 	}
 }
 
+func (a *sCCAssigner) checkAdmission(provider kscc.SecurityContextConstraintsProvider, s *securityapi.PodSecurityPolicySubjectReviewStatus) bool {
+	if a.skipAdmissionCheck {
+		return true
+	}
+	warnings, err := podsecuritypolicysubjectreview.ReplayAdmissionChain(a.admission, provider, a.namespace, a.userInfo, a.spec)
+	if err != nil {
+		s.AllowedBy = nil
+		s.Reason = fmt.Sprintf("denied by admission: %v", err)
+		return false
+	}
+	s.AdmissionWarnings = warnings
+	return true
+}
+
+// errContinueSCCEvaluation is a sentinel Assign returns from its returnAll branch to
+// tell oscc.AssignConstraints to keep iterating and evaluate every applicable SCC
+// even after one has already filled the review. It signals "keep going," not a real
+// failure, so callers must check for it explicitly rather than logging it as an error.
+var errContinueSCCEvaluation = errors.New("continuing evaluation of remaining SecurityContextConstraints")
+
 func (a *sCCAssigner) Assign(provider kscc.SecurityContextConstraintsProvider, constraint *kapi.SecurityContextConstraints) error {
-	filled, err := podsecuritypolicysubjectreview.FillPodSecurityPolicySubjectReviewStatus(a.status, provider, a.spec, constraint)
+	if a.returnAll {
+		iterationStatus := securityapi.PodSecurityPolicySubjectReviewStatus{}
+		filled, err := podsecuritypolicysubjectreview.FillPodSecurityPolicySubjectReviewStatus(&iterationStatus, provider, a.spec, constraint, false)
+		if err == nil && filled {
+			filled = a.checkAdmission(provider, &iterationStatus)
+		}
+		a.status.EvaluatedSCCs = append(a.status.EvaluatedSCCs, securityapi.SCCEvaluationResult{
+			AllowedBy: iterationStatus.AllowedBy,
+			Template:  iterationStatus.Template,
+			Reason:    iterationStatus.Reason,
+		})
+		if filled && a.status.AllowedBy == nil {
+			a.status.AllowedBy = iterationStatus.AllowedBy
+			a.status.Reason = iterationStatus.Reason
+			a.status.Template = iterationStatus.Template
+			a.status.AdmissionWarnings = iterationStatus.AdmissionWarnings
+		}
+		if err != nil {
+			return err
+		}
+		return errContinueSCCEvaluation
+	}
+
+	filled, err := podsecuritypolicysubjectreview.FillPodSecurityPolicySubjectReviewStatus(a.status, provider, a.spec, constraint, false)
 	if !filled || err != nil {
 		if err == nil {
 			err = fmt.Errorf("unknown reason")
 		}
 		return fmt.Errorf("unable to fill PodSecurityPolicySubjectReviewStatus from constraint: %v", err)
 	}
+	if !a.checkAdmission(provider, a.status) {
+		return fmt.Errorf("unable to fill PodSecurityPolicySubjectReviewStatus from constraint: %s", a.status.Reason)
+	}
 	return nil
 }
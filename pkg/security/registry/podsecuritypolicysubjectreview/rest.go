@@ -6,6 +6,7 @@ import (
 
 	"github.com/golang/glog"
 
+	"k8s.io/kubernetes/pkg/admission"
 	kapi "k8s.io/kubernetes/pkg/api"
 	kapierrors "k8s.io/kubernetes/pkg/api/errors"
 	"k8s.io/kubernetes/pkg/auth/user"
@@ -30,11 +31,12 @@ type REST struct {
 	sccMatcher oscc.SCCMatcher
 	groupCache *usercache.GroupCache
 	client     clientset.Interface
+	admission  admission.Interface
 }
 
 // NewREST creates a new REST for policies..
-func NewREST(m oscc.SCCMatcher, g *usercache.GroupCache, c clientset.Interface) *REST {
-	return &REST{sccMatcher: m, groupCache: g, client: c}
+func NewREST(m oscc.SCCMatcher, g *usercache.GroupCache, c clientset.Interface, a admission.Interface) *REST {
+	return &REST{sccMatcher: m, groupCache: g, client: c, admission: a}
 }
 
 // New creates a new PodSecurityPolicySubjectReview object
@@ -124,6 +126,7 @@ func (r *REST) Create(ctx kapi.Context, obj runtime.Object) (runtime.Object, err
 	oscc.DeduplicateSecurityContextConstraints(matchedConstraints)
 	sort.Sort(oscc.ByPriority(matchedConstraints))
 	var namespace *kapi.Namespace
+	firstFilled := false
 	for _, constraint := range matchedConstraints {
 		var (
 			provider kscc.SecurityContextConstraintsProvider
@@ -133,24 +136,114 @@ func (r *REST) Create(ctx kapi.Context, obj runtime.Object) (runtime.Object, err
 			glog.Errorf("Unable to create provider for constraint: %v", err)
 			continue
 		}
-		filled, err := FillPodSecurityPolicySubjectReviewStatus(&pspsr.Status, provider, pspsr.Spec.Template.Spec, constraint)
+		iterationStatus := securityapi.PodSecurityPolicySubjectReviewStatus{}
+		filled, err := FillPodSecurityPolicySubjectReviewStatus(&iterationStatus, provider, pspsr.Spec.Template.Spec, constraint, false)
+		if err == nil && filled && !pspsr.Spec.SkipAdmissionCheck {
+			if warnings, admitErr := ReplayAdmissionChain(r.admission, provider, ns, userInfo, pspsr.Spec.Template.Spec); admitErr != nil {
+				filled = false
+				iterationStatus.AllowedBy = nil
+				iterationStatus.Reason = fmt.Sprintf("denied by admission: %v", admitErr)
+			} else {
+				iterationStatus.AdmissionWarnings = warnings
+			}
+		}
+		if pspsr.Spec.ReturnAll {
+			pspsr.Status.EvaluatedSCCs = append(pspsr.Status.EvaluatedSCCs, securityapi.SCCEvaluationResult{
+				AllowedBy: iterationStatus.AllowedBy,
+				Template:  iterationStatus.Template,
+				Reason:    iterationStatus.Reason,
+			})
+		}
 		if err != nil {
 			glog.Errorf("unable to fill PodSecurityPolicySubjectReviewStatus from constraint %v", err)
 			continue
 		}
-		if filled {
-			return pspsr, nil
+		if filled && !firstFilled {
+			firstFilled = true
+			pspsr.Status.AllowedBy = iterationStatus.AllowedBy
+			pspsr.Status.Reason = iterationStatus.Reason
+			pspsr.Status.Template = iterationStatus.Template
+			pspsr.Status.AdmissionWarnings = iterationStatus.AdmissionWarnings
+			pspsr.Status.Containers = iterationStatus.Containers
+			if !pspsr.Spec.ReturnAll {
+				return pspsr, nil
+			}
 		}
 	}
 	return pspsr, nil
 }
 
-// FillPodSecurityPolicySubjectReviewStatus fills PodSecurityPolicySubjectReviewStatus assigning SecurityContectConstraint to the PodSpec
-func FillPodSecurityPolicySubjectReviewStatus(s *securityapi.PodSecurityPolicySubjectReviewStatus, provider kscc.SecurityContextConstraintsProvider, spec kapi.PodSpec, constraint *kapi.SecurityContextConstraints) (bool, error) {
+// FindSCCForSubject matches the given subject against sccMatcher and fills a
+// PodSecurityPolicySubjectReviewStatus from the first SecurityContextConstraints that
+// successfully assigns a security context to spec. It is shared by the PodSpecReview
+// and PodSpecSubjectReview endpoints so they stay consistent with the matching
+// PodSecurityPolicySubjectReview itself performs.
+func FindSCCForSubject(sccMatcher oscc.SCCMatcher, client clientset.Interface, ns string, userInfo user.Info, spec kapi.PodSpec) (securityapi.PodSecurityPolicySubjectReviewStatus, error) {
+	status := securityapi.PodSecurityPolicySubjectReviewStatus{}
+	matchedConstraints, err := sccMatcher.FindApplicableSCCs(userInfo)
+	if err != nil {
+		return status, fmt.Errorf("unable to find SecurityContextConstraints: %v", err)
+	}
+	oscc.DeduplicateSecurityContextConstraints(matchedConstraints)
+	sort.Sort(oscc.ByPriority(matchedConstraints))
+	var namespace *kapi.Namespace
+	for _, constraint := range matchedConstraints {
+		provider, resolvedNamespace, err := oscc.CreateProviderFromConstraint(ns, namespace, constraint, client)
+		namespace = resolvedNamespace
+		if err != nil {
+			glog.Errorf("Unable to create provider for constraint: %v", err)
+			continue
+		}
+		filled, err := FillPodSecurityPolicySubjectReviewStatus(&status, provider, spec, constraint, false)
+		if err != nil {
+			glog.Errorf("unable to fill PodSecurityPolicySubjectReviewStatus from constraint %v", err)
+			continue
+		}
+		if filled {
+			break
+		}
+	}
+	return status, nil
+}
+
+// warningsAdmission is implemented by admission plugins that can surface non-fatal
+// warnings alongside a nil Admit error.
+type warningsAdmission interface {
+	Warnings() []string
+}
+
+// ReplayAdmissionChain re-assigns the SCC to a throwaway pod built from spec and runs
+// it through the rest of the admission chain (quota, resource limits, image policy, ...)
+// so the review doesn't report AllowedBy for a pod that admission would still reject.
+func ReplayAdmissionChain(admissionControl admission.Interface, provider kscc.SecurityContextConstraintsProvider, ns string, userInfo user.Info, spec kapi.PodSpec) ([]string, error) {
+	if admissionControl == nil {
+		return nil, nil
+	}
+	pod := &kapi.Pod{Spec: spec}
+	if errs := oscc.AssignSecurityContext(provider, pod, field.NewPath(fmt.Sprintf("provider %s: ", provider.GetSCCName()))); len(errs) > 0 {
+		return nil, errs.ToAggregate()
+	}
+	attrs := admission.NewAttributesRecord(pod, nil, kapi.Kind("Pod").WithVersion(""), ns, pod.Name,
+		kapi.Resource("pods").WithVersion(""), "", admission.Create, userInfo)
+	if err := admissionControl.Admit(attrs); err != nil {
+		return nil, err
+	}
+	if w, ok := admissionControl.(warningsAdmission); ok {
+		return w.Warnings(), nil
+	}
+	return nil, nil
+}
+
+// FillPodSecurityPolicySubjectReviewStatus fills PodSecurityPolicySubjectReviewStatus assigning SecurityContectConstraint to the PodSpec.
+// The mutated PodSpec is only copied into s.Template.Spec when the incoming spec
+// already names a ServiceAccount, unless alwaysReturnTemplate overrides that.
+func FillPodSecurityPolicySubjectReviewStatus(s *securityapi.PodSecurityPolicySubjectReviewStatus, provider kscc.SecurityContextConstraintsProvider, spec kapi.PodSpec, constraint *kapi.SecurityContextConstraints, alwaysReturnTemplate bool) (bool, error) {
 	pod := &kapi.Pod{
 		Spec: spec,
 	}
-	if errs := oscc.AssignSecurityContext(provider, pod, field.NewPath(fmt.Sprintf("provider %s: ", provider.GetSCCName()))); len(errs) > 0 {
+	errs := oscc.AssignSecurityContext(provider, pod, field.NewPath(fmt.Sprintf("provider %s: ", provider.GetSCCName())))
+	s.Containers = containerSCCReviewStatuses(provider, pod, len(errs) > 0)
+	if len(errs) > 0 {
 		glog.Errorf("unable to assign SecurityContextConstraints provider: %v", errs)
 		s.Reason = "CantAssignSecurityContextConstraintProvider"
 		return false, fmt.Errorf("unable to assign SecurityContextConstraints provider: %v", errs.ToAggregate())
@@ -162,8 +255,40 @@ func FillPodSecurityPolicySubjectReviewStatus(s *securityapi.PodSecurityPolicySu
 	}
 	s.AllowedBy = ref
 
-	if len(spec.ServiceAccountName) > 0 {
+	if alwaysReturnTemplate || len(spec.ServiceAccountName) > 0 {
 		s.Template.Spec = pod.Spec
 	}
 	return true, nil
 }
+
+// containerSCCReviewStatuses builds a per-container breakdown of how provider mutated
+// (or failed to mutate) each container and init container of pod, so callers can see
+// which container forced a stricter SCC or was rejected, rather than just a pod-wide
+// pass/fail.
+func containerSCCReviewStatuses(provider kscc.SecurityContextConstraintsProvider, pod *kapi.Pod, podAssignmentFailed bool) []securityapi.ContainerSCCReviewStatus {
+	statuses := containerSCCReviewStatusesForList(provider, pod.Spec.Containers, "containers", podAssignmentFailed)
+	return append(statuses, containerSCCReviewStatusesForList(provider, pod.Spec.InitContainers, "initContainers", podAssignmentFailed)...)
+}
+
+func containerSCCReviewStatusesForList(provider kscc.SecurityContextConstraintsProvider, containers []kapi.Container, fieldName string, podAssignmentFailed bool) []securityapi.ContainerSCCReviewStatus {
+	statuses := make([]securityapi.ContainerSCCReviewStatus, 0, len(containers))
+	for i, container := range containers {
+		status := securityapi.ContainerSCCReviewStatus{
+			Name:                     container.Name,
+			EffectiveSecurityContext: container.SecurityContext,
+		}
+		if podAssignmentFailed {
+			// the pod as a whole didn't assign cleanly; re-run the provider against a
+			// single-container pod so the failing field can be attributed to the
+			// container that actually caused it.
+			singleton := &kapi.Pod{Spec: kapi.PodSpec{Containers: []kapi.Container{container}}}
+			if errs := oscc.AssignSecurityContext(provider, singleton, field.NewPath("spec", fieldName).Index(i)); len(errs) > 0 {
+				status.Reason = errs.ToAggregate().Error()
+			} else {
+				status.EffectiveSecurityContext = singleton.Spec.Containers[0].SecurityContext
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
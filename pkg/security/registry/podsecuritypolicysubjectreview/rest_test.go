@@ -1,16 +1,16 @@
 package podsecuritypolicysubjectreview
 
 import (
+	"errors"
 	"testing"
 
+	"k8s.io/kubernetes/pkg/admission"
 	kapi "k8s.io/kubernetes/pkg/api"
-	"k8s.io/kubernetes/pkg/auth/user"
 	"k8s.io/kubernetes/pkg/client/cache"
 	clientsetfake "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset/fake"
 	"k8s.io/kubernetes/pkg/util/sets"
 	"k8s.io/kubernetes/pkg/watch"
 
-	"github.com/openshift/origin/pkg/authorization/authorizer"
 	oscache "github.com/openshift/origin/pkg/client/cache"
 	admissionttesting "github.com/openshift/origin/pkg/security/admission/testing"
 	securityapi "github.com/openshift/origin/pkg/security/api"
@@ -41,22 +41,26 @@ func (*groupCache) WatchGroups(ctx kapi.Context, options *kapi.ListOptions) (wat
 	return watch.NewFake(), nil
 }
 
-type testAuthorizer struct {
-	allowed bool
-	reason  string
-	err     string
-
-	actualAttributes authorizer.DefaultAuthorizationAttributes
-	actualUserInfo   user.Info
+// fakeAdmission is a minimal admission.Interface double. When deny is set,
+// ReplayAdmissionChain's Admit call fails with reason, standing in for a
+// quota/limit-range plugin downstream of the SCC assignment itself.
+type fakeAdmission struct {
+	deny     bool
+	reason   string
+	admitted []admission.Attributes
 }
 
-func (a *testAuthorizer) Authorize(ctx kapi.Context, passedAttributes authorizer.Action) (allowed bool, reason string, err error) {
-	a.actualUserInfo, _ = kapi.UserFrom(ctx)
-	return true, "", nil
+func (a *fakeAdmission) Admit(attrs admission.Attributes) error {
+	a.admitted = append(a.admitted, attrs)
+	if a.deny {
+		return errors.New(a.reason)
+	}
+	return nil
 }
-func (a *testAuthorizer) GetAllowedSubjects(ctx kapi.Context, passedAttributes authorizer.Action) (sets.String, sets.String, error) {
-	return sets.String{}, sets.String{}, nil
+func (a *fakeAdmission) Handles(operation admission.Operation) bool {
+	return true
 }
+
 func saSCC() *kapi.SecurityContextConstraints {
 	return &kapi.SecurityContextConstraints{
 		ObjectMeta: kapi.ObjectMeta{
@@ -167,11 +171,13 @@ func TestAllowed(t *testing.T) {
 		}
 
 		groupCache := usercache.NewGroupCache(&groupCache{})
-		authorizer := &testAuthorizer{
-			allowed: true,
-		}
 		csf := clientsetfake.NewSimpleClientset(namespace, serviceAccount)
-		storage := REST{oscc.NewDefaultSCCMatcher(cache), groupCache, authorizer, csf}
+		storage := REST{
+			sccMatcher: oscc.NewDefaultSCCMatcher(cache),
+			groupCache: groupCache,
+			client:     csf,
+			admission:  &fakeAdmission{},
+		}
 		ctx := kapi.WithNamespace(kapi.NewContext(), "default")
 		obj, err := storage.Create(ctx, reviewRequest)
 		if err != nil {
@@ -283,10 +289,12 @@ func TestRequests(t *testing.T) {
 		}
 		csf := clientsetfake.NewSimpleClientset(namespace, serviceAccount)
 		groupCache := usercache.NewGroupCache(&groupCache{})
-		authorizer := &testAuthorizer{
-			allowed: false,
+		storage := REST{
+			sccMatcher: oscc.NewDefaultSCCMatcher(sccCache),
+			groupCache: groupCache,
+			client:     csf,
+			admission:  &fakeAdmission{},
 		}
-		storage := REST{oscc.NewDefaultSCCMatcher(sccCache), groupCache, authorizer, csf}
 		ctx := kapi.WithNamespace(kapi.NewContext(), "default")
 		_, err := storage.Create(ctx, testcase.request)
 		switch {
@@ -301,3 +309,156 @@ func TestRequests(t *testing.T) {
 	}
 
 }
+
+// newTestREST builds a REST backed by sccs and the given admission double,
+// wired the same way TestAllowed/TestRequests do.
+func newTestREST(sccs []*kapi.SecurityContextConstraints, namespace *kapi.Namespace, serviceAccount *kapi.ServiceAccount, admit *fakeAdmission) REST {
+	indexer := &oscache.IndexerToSecurityContextConstraintsLister{
+		Indexer: cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+	}
+	for _, scc := range sccs {
+		_ = indexer.Add(scc)
+	}
+	return REST{
+		sccMatcher: oscc.NewDefaultSCCMatcher(indexer),
+		groupCache: usercache.NewGroupCache(&groupCache{}),
+		client:     clientsetfake.NewSimpleClientset(namespace, serviceAccount),
+		admission:  admit,
+	}
+}
+
+// TestReturnAll verifies that when Spec.ReturnAll is set, every matching SCC
+// is recorded in Status.EvaluatedSCCs rather than stopping at the first one
+// that assigns successfully.
+func TestReturnAll(t *testing.T) {
+	namespace := admissionttesting.CreateNamespaceForTest()
+	serviceAccount := admissionttesting.CreateSAForTest()
+	storage := newTestREST([]*kapi.SecurityContextConstraints{
+		admissionttesting.UserScc("bar"),
+		admissionttesting.UserScc("foo"),
+	}, namespace, serviceAccount, &fakeAdmission{})
+
+	reviewRequest := &securityapi.PodSecurityPolicySubjectReview{
+		Spec: securityapi.PodSecurityPolicySubjectReviewSpec{
+			Template: kapi.PodTemplateSpec{
+				Spec: kapi.PodSpec{
+					Containers:         []kapi.Container{{Name: "ctr", Image: "image", ImagePullPolicy: "IfNotPresent"}},
+					RestartPolicy:      kapi.RestartPolicyAlways,
+					SecurityContext:    &kapi.PodSecurityContext{},
+					DNSPolicy:          kapi.DNSClusterFirst,
+					ServiceAccountName: "default",
+				},
+			},
+			User:      "foo",
+			Groups:    []string{"bar", "baz"},
+			ReturnAll: true,
+		},
+	}
+	ctx := kapi.WithNamespace(kapi.NewContext(), "default")
+	obj, err := storage.Create(ctx, reviewRequest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pspsr := obj.(*securityapi.PodSecurityPolicySubjectReview)
+	if len(pspsr.Status.EvaluatedSCCs) != 2 {
+		t.Errorf("expected both matching SCCs to be recorded in EvaluatedSCCs, got %d: %#v", len(pspsr.Status.EvaluatedSCCs), pspsr.Status.EvaluatedSCCs)
+	}
+	if pspsr.Status.AllowedBy == nil {
+		t.Errorf("expected Status.AllowedBy to still be filled from the first successful SCC")
+	}
+}
+
+// TestSkipAdmissionCheck verifies that a downstream admission denial clears
+// AllowedBy unless Spec.SkipAdmissionCheck bypasses the replay entirely.
+func TestSkipAdmissionCheck(t *testing.T) {
+	namespace := admissionttesting.CreateNamespaceForTest()
+	serviceAccount := admissionttesting.CreateSAForTest()
+	newRequest := func(skip bool) *securityapi.PodSecurityPolicySubjectReview {
+		return &securityapi.PodSecurityPolicySubjectReview{
+			Spec: securityapi.PodSecurityPolicySubjectReviewSpec{
+				Template: kapi.PodTemplateSpec{
+					Spec: kapi.PodSpec{
+						Containers:         []kapi.Container{{Name: "ctr", Image: "image", ImagePullPolicy: "IfNotPresent"}},
+						RestartPolicy:      kapi.RestartPolicyAlways,
+						SecurityContext:    &kapi.PodSecurityContext{},
+						DNSPolicy:          kapi.DNSClusterFirst,
+						ServiceAccountName: "default",
+					},
+				},
+				User:               "foo",
+				Groups:             []string{"bar", "baz"},
+				SkipAdmissionCheck: skip,
+			},
+		}
+	}
+
+	ctx := kapi.WithNamespace(kapi.NewContext(), "default")
+
+	notSkipped := &fakeAdmission{deny: true, reason: "denied for test"}
+	storage := newTestREST([]*kapi.SecurityContextConstraints{admissionttesting.UserScc("foo")}, namespace, serviceAccount, notSkipped)
+	obj, err := storage.Create(ctx, newRequest(false))
+	if err != nil {
+		t.Fatalf("admission denied, not skipped: unexpected error: %v", err)
+	}
+	pspsr := obj.(*securityapi.PodSecurityPolicySubjectReview)
+	if pspsr.Status.AllowedBy != nil {
+		t.Errorf("admission denied, not skipped: expected AllowedBy to be nil when admission denies the replayed pod, got %#v", pspsr.Status.AllowedBy)
+	}
+
+	skipped := &fakeAdmission{deny: true, reason: "denied for test"}
+	storage = newTestREST([]*kapi.SecurityContextConstraints{admissionttesting.UserScc("foo")}, namespace, serviceAccount, skipped)
+	obj, err = storage.Create(ctx, newRequest(true))
+	if err != nil {
+		t.Fatalf("admission denied, skipped: unexpected error: %v", err)
+	}
+	pspsr = obj.(*securityapi.PodSecurityPolicySubjectReview)
+	if pspsr.Status.AllowedBy == nil {
+		t.Errorf("admission denied, skipped: expected AllowedBy to be filled when SkipAdmissionCheck bypasses the denial")
+	}
+	if len(skipped.admitted) != 0 {
+		t.Errorf("admission denied, skipped: expected admission to never be consulted when SkipAdmissionCheck is set, got %d calls", len(skipped.admitted))
+	}
+}
+
+// TestContainerStatuses verifies that Status.Containers carries one entry per
+// container in the template, keyed by container name.
+func TestContainerStatuses(t *testing.T) {
+	namespace := admissionttesting.CreateNamespaceForTest()
+	serviceAccount := admissionttesting.CreateSAForTest()
+	storage := newTestREST([]*kapi.SecurityContextConstraints{admissionttesting.UserScc("foo")}, namespace, serviceAccount, &fakeAdmission{})
+
+	reviewRequest := &securityapi.PodSecurityPolicySubjectReview{
+		Spec: securityapi.PodSecurityPolicySubjectReviewSpec{
+			Template: kapi.PodTemplateSpec{
+				Spec: kapi.PodSpec{
+					Containers: []kapi.Container{
+						{Name: "first", Image: "image", ImagePullPolicy: "IfNotPresent"},
+						{Name: "second", Image: "image", ImagePullPolicy: "IfNotPresent"},
+					},
+					RestartPolicy:      kapi.RestartPolicyAlways,
+					SecurityContext:    &kapi.PodSecurityContext{},
+					DNSPolicy:          kapi.DNSClusterFirst,
+					ServiceAccountName: "default",
+				},
+			},
+			User: "foo",
+		},
+	}
+	ctx := kapi.WithNamespace(kapi.NewContext(), "default")
+	obj, err := storage.Create(ctx, reviewRequest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pspsr := obj.(*securityapi.PodSecurityPolicySubjectReview)
+	if len(pspsr.Status.Containers) != 2 {
+		t.Fatalf("expected one status per container, got %d: %#v", len(pspsr.Status.Containers), pspsr.Status.Containers)
+	}
+	names := sets.NewString()
+	for _, c := range pspsr.Status.Containers {
+		names.Insert(c.Name)
+	}
+	if !names.HasAll("first", "second") {
+		t.Errorf("expected Containers to cover both container names, got %#v", names.List())
+	}
+}
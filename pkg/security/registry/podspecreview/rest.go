@@ -3,23 +3,35 @@ package podspecreview
 import (
 	"fmt"
 
+	"github.com/golang/glog"
+
 	kapi "k8s.io/kubernetes/pkg/api"
 	kapierrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/auth/user"
+	clientset "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
 	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/serviceaccount"
 
 	"github.com/openshift/origin/pkg/authorization/authorizer"
+	"github.com/openshift/origin/pkg/cmd/server/bootstrappolicy"
 	securityapi "github.com/openshift/origin/pkg/security/api"
 	securityvalidation "github.com/openshift/origin/pkg/security/api/validation"
+	"github.com/openshift/origin/pkg/security/registry/podsecuritypolicysubjectreview"
+	oscc "github.com/openshift/origin/pkg/security/scc"
+	usercache "github.com/openshift/origin/pkg/user/cache"
 )
 
 // REST implements the RESTStorage interface in terms of an Registry.
 type REST struct {
 	authorizer authorizer.Authorizer
+	sccMatcher oscc.SCCMatcher
+	groupCache *usercache.GroupCache
+	client     clientset.Interface
 }
 
 // NewREST creates a new REST for policies..
-func NewREST(authorizer authorizer.Authorizer) *REST {
-	return &REST{authorizer}
+func NewREST(authorizer authorizer.Authorizer, sccMatcher oscc.SCCMatcher, groupCache *usercache.GroupCache, client clientset.Interface) *REST {
+	return &REST{authorizer, sccMatcher, groupCache, client}
 }
 
 // New creates a new PodSpecReview object
@@ -36,9 +48,69 @@ func (r *REST) Create(ctx kapi.Context, obj runtime.Object) (runtime.Object, err
 	if errs := securityvalidation.ValidatePodSpecReview(podSpecReview); len(errs) > 0 {
 		return nil, kapierrors.NewInvalid(securityapi.Kind(podSpecReview.Kind), "", errs)
 	}
+	ns, ok := kapi.NamespaceFrom(ctx)
+	if !ok {
+		return nil, kapierrors.NewBadRequest("namespace parameter required.")
+	}
 	newPodSpecReview := &securityapi.PodSpecReview{}
 	newPodSpecReview.Spec = podSpecReview.Spec
 
-	// TODO: add logic to fill response
+	// find every user or service account that is allowed to create this pod in the
+	// namespace, then run each of them through the same SCC matching path used by
+	// PodSecurityPolicySubjectReview.
+	users, _, err := r.authorizer.GetAllowedSubjects(ctx, &authorizer.DefaultAuthorizationAttributes{
+		Verb:     "create",
+		Resource: "pods",
+	})
+	if err != nil {
+		return nil, kapierrors.NewBadRequest(fmt.Sprintf("unable to compute allowed subjects: %v", err))
+	}
+	for _, username := range users.List() {
+		userInfo, subjectName, ok := r.subjectUserInfo(username, ns)
+		if !ok {
+			// a service account outside the review's namespace couldn't run this
+			// pod here regardless of what it's allowed to do elsewhere.
+			continue
+		}
+		status, err := podsecuritypolicysubjectreview.FindSCCForSubject(r.sccMatcher, r.client, ns, userInfo, podSpecReview.Spec.PodSpec)
+		if err != nil {
+			glog.Errorf("unable to compute allowed SecurityContextConstraints for %s: %v", subjectName, err)
+			continue
+		}
+		newPodSpecReview.Status.AllowedServiceAccounts = append(newPodSpecReview.Status.AllowedServiceAccounts,
+			securityapi.ServiceAccountPodSubjectReviewStatus{status, subjectName})
+	}
+
 	return newPodSpecReview, nil
 }
+
+// subjectUserInfo turns a username GetAllowedSubjects returned into the user.Info
+// FindSCCForSubject needs to match SCCs: a service account outside ns is out of
+// scope and returns ok=false; a service account in ns gets only the
+// project/serviceaccount groups of serviceaccount.UserInfo, without the
+// authenticated group; any other subject gets whatever r.groupCache knows about it
+// plus the authenticated and authenticated-oauth groups (or, for system:anonymous,
+// the unauthenticated group). Other system users are not told apart from regular
+// users, so unlike PodSecurityPolicySubjectReview they also get the cached and
+// authenticated-oauth groups.
+func (r *REST) subjectUserInfo(username, ns string) (user.Info, string, bool) {
+	if saNamespace, saName, err := serviceaccount.SplitUsername(username); err == nil {
+		if saNamespace != ns {
+			return nil, "", false
+		}
+		return serviceaccount.UserInfo(saNamespace, saName, ""), saName, true
+	}
+
+	groups := []string{}
+	if actualGroups, err := r.groupCache.GroupsFor(username); err == nil {
+		for _, group := range actualGroups {
+			groups = append(groups, group.Name)
+		}
+	}
+	if username == bootstrappolicy.UnauthenticatedUsername {
+		groups = append(groups, bootstrappolicy.UnauthenticatedGroup)
+	} else {
+		groups = append(groups, bootstrappolicy.AuthenticatedGroup, bootstrappolicy.AuthenticatedOAuthGroup)
+	}
+	return &user.DefaultInfo{Name: username, Groups: groups}, username, true
+}
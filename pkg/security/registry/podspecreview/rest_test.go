@@ -0,0 +1,126 @@
+package podspecreview
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+	clientsetfake "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset/fake"
+	"k8s.io/kubernetes/pkg/util/sets"
+	"k8s.io/kubernetes/pkg/watch"
+
+	"github.com/openshift/origin/pkg/authorization/authorizer"
+	oscache "github.com/openshift/origin/pkg/client/cache"
+	admissionttesting "github.com/openshift/origin/pkg/security/admission/testing"
+	securityapi "github.com/openshift/origin/pkg/security/api"
+	oscc "github.com/openshift/origin/pkg/security/scc"
+	userapi "github.com/openshift/origin/pkg/user/api"
+	usercache "github.com/openshift/origin/pkg/user/cache"
+)
+
+// fakeAuthorizer returns a fixed set of subjects from GetAllowedSubjects,
+// standing in for the real RBAC-backed GetAllowedSubjects("create", "pods").
+type fakeAuthorizer struct {
+	users sets.String
+}
+
+func (f *fakeAuthorizer) Authorize(ctx kapi.Context, a authorizer.Action) (bool, string, error) {
+	return true, "allowed for test", nil
+}
+
+func (f *fakeAuthorizer) GetAllowedSubjects(ctx kapi.Context, a authorizer.Action) (sets.String, sets.String, error) {
+	return f.users, sets.String{}, nil
+}
+
+type groupCache struct{}
+
+func (*groupCache) ListGroups(ctx kapi.Context, options *kapi.ListOptions) (*userapi.GroupList, error) {
+	return &userapi.GroupList{}, nil
+}
+func (*groupCache) GetGroup(ctx kapi.Context, name string) (*userapi.Group, error) {
+	return nil, nil
+}
+func (*groupCache) CreateGroup(ctx kapi.Context, group *userapi.Group) (*userapi.Group, error) {
+	return nil, nil
+}
+func (*groupCache) UpdateGroup(ctx kapi.Context, group *userapi.Group) (*userapi.Group, error) {
+	return nil, nil
+}
+func (*groupCache) DeleteGroup(ctx kapi.Context, name string) error {
+	return nil
+}
+func (*groupCache) WatchGroups(ctx kapi.Context, options *kapi.ListOptions) (watch.Interface, error) {
+	return watch.NewFake(), nil
+}
+
+func TestCreateReportsServiceAccountsAndUsers(t *testing.T) {
+	namespace := admissionttesting.CreateNamespaceForTest()
+	serviceAccount := admissionttesting.CreateSAForTest()
+	serviceAccount.Namespace = namespace.Name
+
+	sccCache := &oscache.IndexerToSecurityContextConstraintsLister{
+		Indexer: cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+	}
+	for _, scc := range []*kapi.SecurityContextConstraints{
+		admissionttesting.UserScc("bob"),
+		{
+			ObjectMeta: kapi.ObjectMeta{
+				SelfLink: "/api/version/securitycontextconstraints/scc-sa",
+				Name:     "scc-sa",
+			},
+			RunAsUser:          kapi.RunAsUserStrategyOptions{Type: kapi.RunAsUserStrategyMustRunAsRange},
+			SELinuxContext:     kapi.SELinuxContextStrategyOptions{Type: kapi.SELinuxStrategyMustRunAs},
+			FSGroup:            kapi.FSGroupStrategyOptions{Type: kapi.FSGroupStrategyMustRunAs},
+			SupplementalGroups: kapi.SupplementalGroupsStrategyOptions{Type: kapi.SupplementalGroupsStrategyMustRunAs},
+			Groups:             []string{"system:serviceaccounts"},
+		},
+	} {
+		if err := sccCache.Add(scc); err != nil {
+			t.Fatalf("error adding scc to store: %v", err)
+		}
+	}
+
+	storage := &REST{
+		authorizer: &fakeAuthorizer{users: sets.NewString(
+			"bob",
+			"system:serviceaccount:"+namespace.Name+":default",
+			"system:serviceaccount:other-ns:default",
+		)},
+		sccMatcher: oscc.NewDefaultSCCMatcher(sccCache),
+		groupCache: usercache.NewGroupCache(&groupCache{}),
+		client:     clientsetfake.NewSimpleClientset(namespace, serviceAccount),
+	}
+
+	request := &securityapi.PodSpecReview{
+		Spec: securityapi.PodSpecReviewSpec{
+			PodSpec: kapi.PodSpec{
+				Containers:         []kapi.Container{{Name: "ctr", Image: "image", ImagePullPolicy: "IfNotPresent"}},
+				RestartPolicy:      kapi.RestartPolicyAlways,
+				SecurityContext:    &kapi.PodSecurityContext{},
+				DNSPolicy:          kapi.DNSClusterFirst,
+				ServiceAccountName: "default",
+			},
+		},
+	}
+	ctx := kapi.WithNamespace(kapi.NewContext(), namespace.Name)
+	obj, err := storage.Create(ctx, request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	review := obj.(*securityapi.PodSpecReview)
+
+	var names []string
+	for _, allowed := range review.Status.AllowedServiceAccounts {
+		names = append(names, allowed.Name)
+	}
+	sort.Strings(names)
+	// the service account in another namespace must be excluded; "bob" (a
+	// regular user) and "default" (the in-namespace service account) must
+	// both be evaluated, not just the service account.
+	if expected := []string{"bob", "default"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected AllowedServiceAccounts for %v, got %v", expected, names)
+	}
+}
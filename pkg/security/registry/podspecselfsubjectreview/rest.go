@@ -2,24 +2,34 @@ package podspecselfsubjectreview
 
 import (
 	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
 
 	kapi "k8s.io/kubernetes/pkg/api"
 	kapierrors "k8s.io/kubernetes/pkg/api/errors"
+	clientset "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
 	"k8s.io/kubernetes/pkg/runtime"
+	kscc "k8s.io/kubernetes/pkg/securitycontextconstraints"
+	"k8s.io/kubernetes/pkg/serviceaccount"
 
 	"github.com/openshift/origin/pkg/authorization/authorizer"
 	securityapi "github.com/openshift/origin/pkg/security/api"
 	securityvalidation "github.com/openshift/origin/pkg/security/api/validation"
+	"github.com/openshift/origin/pkg/security/registry/podsecuritypolicysubjectreview"
+	oscc "github.com/openshift/origin/pkg/security/scc"
 )
 
 // REST implements the RESTStorage interface in terms of an Registry.
 type REST struct {
 	authorizer authorizer.Authorizer
+	sccMatcher oscc.SCCMatcher
+	client     clientset.Interface
 }
 
 // NewREST creates a new REST for policies.
-func NewREST(authorizer authorizer.Authorizer) *REST {
-	return &REST{authorizer}
+func NewREST(authorizer authorizer.Authorizer, sccMatcher oscc.SCCMatcher, client clientset.Interface) *REST {
+	return &REST{authorizer, sccMatcher, client}
 }
 
 // New creates a new PodSpecSelfSubjectReview object
@@ -36,8 +46,52 @@ func (r *REST) Create(ctx kapi.Context, obj runtime.Object) (runtime.Object, err
 	if errs := securityvalidation.ValidatePodSpecSelfSubjectReview(podSpecSelfSubjectReview); len(errs) > 0 {
 		return nil, kapierrors.NewInvalid(securityapi.Kind(podSpecSelfSubjectReview.Kind), "", errs)
 	}
+	ns, ok := kapi.NamespaceFrom(ctx)
+	if !ok {
+		return nil, kapierrors.NewBadRequest("namespace parameter required.")
+	}
+	userInfo, ok := kapi.UserFrom(ctx)
+	if !ok {
+		return nil, kapierrors.NewBadRequest("no user data associated with context")
+	}
+
 	newPodSpecSelfSubjectReview := &securityapi.PodSpecSelfSubjectReview{}
 	newPodSpecSelfSubjectReview.Spec = podSpecSelfSubjectReview.Spec
-	// TODO: add logic to fill response
+
+	matchedConstraints, err := r.sccMatcher.FindApplicableSCCs(userInfo)
+	if err != nil {
+		return nil, kapierrors.NewBadRequest(fmt.Sprintf("unable to find SecurityContextConstraints: %v", err))
+	}
+	// the pod may run as a ServiceAccount rather than as the caller, so whatever that
+	// ServiceAccount could additionally run under counts too.
+	saName := podSpecSelfSubjectReview.Spec.PodSpec.ServiceAccountName
+	if len(saName) > 0 {
+		saUserInfo := serviceaccount.UserInfo(ns, saName, "")
+		saConstraints, err := r.sccMatcher.FindApplicableSCCs(saUserInfo)
+		if err != nil {
+			return nil, kapierrors.NewBadRequest(fmt.Sprintf("unable to find SecurityContextConstraints: %v", err))
+		}
+		matchedConstraints = append(matchedConstraints, saConstraints...)
+	}
+	oscc.DeduplicateSecurityContextConstraints(matchedConstraints)
+	sort.Sort(oscc.ByPriority(matchedConstraints))
+
+	var namespace *kapi.Namespace
+	for _, constraint := range matchedConstraints {
+		var provider kscc.SecurityContextConstraintsProvider
+		provider, namespace, err = oscc.CreateProviderFromConstraint(ns, namespace, constraint, r.client)
+		if err != nil {
+			glog.Errorf("Unable to create provider for constraint: %v", err)
+			continue
+		}
+		filled, err := podsecuritypolicysubjectreview.FillPodSecurityPolicySubjectReviewStatus(&newPodSpecSelfSubjectReview.Status, provider, podSpecSelfSubjectReview.Spec.PodSpec, constraint, false)
+		if err != nil {
+			glog.Errorf("unable to fill PodSecurityPolicySubjectReviewStatus from constraint %v", err)
+			continue
+		}
+		if filled {
+			break
+		}
+	}
 	return newPodSpecSelfSubjectReview, nil
 }
@@ -5,21 +5,32 @@ import (
 
 	kapi "k8s.io/kubernetes/pkg/api"
 	kapierrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/auth/user"
+	clientset "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
 	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/serviceaccount"
 
-	"github.com/openshift/origin/pkg/authorization/authorizer"
+	authorizationapi "github.com/openshift/origin/pkg/authorization/api"
+	"github.com/openshift/origin/pkg/cmd/server/bootstrappolicy"
 	securityapi "github.com/openshift/origin/pkg/security/api"
 	securityvalidation "github.com/openshift/origin/pkg/security/api/validation"
+	"github.com/openshift/origin/pkg/security/registry/podsecuritypolicysubjectreview"
+	oscc "github.com/openshift/origin/pkg/security/scc"
+	userapi "github.com/openshift/origin/pkg/user/api"
+	uservalidation "github.com/openshift/origin/pkg/user/api/validation"
+	usercache "github.com/openshift/origin/pkg/user/cache"
 )
 
 // REST implements the RESTStorage interface in terms of an Registry.
 type REST struct {
-	authorizer authorizer.Authorizer
+	sccMatcher oscc.SCCMatcher
+	groupCache *usercache.GroupCache
+	client     clientset.Interface
 }
 
 // NewREST creates a new REST for policies.
-func NewREST(authorizer authorizer.Authorizer) *REST {
-	return &REST{authorizer}
+func NewREST(sccMatcher oscc.SCCMatcher, groupCache *usercache.GroupCache, client clientset.Interface) *REST {
+	return &REST{sccMatcher, groupCache, client}
 }
 
 // New creates a new PodSpecSubjectReview object
@@ -36,8 +47,67 @@ func (r *REST) Create(ctx kapi.Context, obj runtime.Object) (runtime.Object, err
 	if errs := securityvalidation.ValidatePodSpecSubjectReview(podSpecSubjectReview); len(errs) > 0 {
 		return nil, kapierrors.NewInvalid(securityapi.Kind(podSpecSubjectReview.Kind), "", errs)
 	}
+	ns, ok := kapi.NamespaceFrom(ctx)
+	if !ok {
+		return nil, kapierrors.NewBadRequest("namespace parameter required.")
+	}
 	newPodSpecSubjectReview := &securityapi.PodSpecSubjectReview{}
 	newPodSpecSubjectReview.Spec = podSpecSubjectReview.Spec
-	// TODO: add logic to fill response
+
+	subjects := authorizationapi.BuildSubjects([]string{podSpecSubjectReview.Spec.User}, podSpecSubjectReview.Spec.Groups,
+		// validates whether the usernames are regular users or system users
+		uservalidation.ValidateUserName,
+		// validates group names are regular groups or system groups
+		uservalidation.ValidateGroupName)
+
+	groupsSpecified := podSpecSubjectReview.Spec.Groups != nil
+	groups := podSpecSubjectReview.Spec.Groups
+	username := podSpecSubjectReview.Spec.User
+	for _, subject := range subjects {
+		switch subject.GetObjectKind().GroupVersionKind().GroupKind() {
+		case userapi.Kind(authorizationapi.GroupKind):
+			groups = append(groups, subject.Name)
+
+		case userapi.Kind(authorizationapi.SystemGroupKind):
+			groups = append(groups, subject.Name)
+
+		case userapi.Kind(authorizationapi.UserKind):
+			username = subject.Name
+			if !groupsSpecified {
+				if actualGroups, err := r.groupCache.GroupsFor(subject.Name); err == nil {
+					for _, group := range actualGroups {
+						groups = append(groups, group.Name)
+					}
+				}
+				groups = append(groups, bootstrappolicy.AuthenticatedGroup, bootstrappolicy.AuthenticatedOAuthGroup)
+			}
+
+		case userapi.Kind(authorizationapi.SystemUserKind):
+			username = subject.Name
+			if !groupsSpecified {
+				if subject.Name == bootstrappolicy.UnauthenticatedUsername {
+					groups = append(groups, bootstrappolicy.UnauthenticatedGroup)
+				} else {
+					groups = append(groups, bootstrappolicy.AuthenticatedGroup)
+				}
+			}
+
+		case kapi.Kind(authorizationapi.ServiceAccountKind):
+			username = serviceaccount.MakeUsername(subject.Namespace, subject.Name)
+			if !groupsSpecified {
+				groups = append(serviceaccount.MakeGroupNames(subject.Namespace, subject.Name), bootstrappolicy.AuthenticatedGroup)
+			}
+
+		default:
+			return nil, kapierrors.NewBadRequest(fmt.Sprintf("unknown subject type: %v", subject))
+		}
+	}
+
+	userInfo := &user.DefaultInfo{Name: username, Groups: groups}
+	status, err := podsecuritypolicysubjectreview.FindSCCForSubject(r.sccMatcher, r.client, ns, userInfo, podSpecSubjectReview.Spec.PodSpec)
+	if err != nil {
+		return nil, kapierrors.NewBadRequest(fmt.Sprintf("unable to compute allowed SecurityContextConstraints: %v", err))
+	}
+	newPodSpecSubjectReview.Status = status
 	return newPodSpecSubjectReview, nil
 }